@@ -0,0 +1,155 @@
+package webterm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nyxtom/webterm/glob"
+)
+
+// maxExecBody caps the size of a POST /exec body, large enough for any file the editor saves
+const maxExecBody = 32 << 20
+
+// execRequest is the JSON body of POST /exec, the command is sent as is
+// while the arguments are never re-tokenised
+type execRequest struct {
+	Cmd  string            `json:"cmd"`
+	Args []json.RawMessage `json:"args"`
+	Cwd  string            `json:"cwd"`
+}
+
+// execArg is an argument with an explicit type. Plain JSON strings, numbers
+// and booleans are accepted as arguments as well.
+//
+//	{"type": "string", "value": "a literal string"}
+//	{"type": "glob", "value": "*.go"}
+//	{"type": "int", "value": 42}
+//	{"type": "float", "value": 4.2}
+//	{"type": "bool", "value": true}
+//	{"type": "base64", "value": "aGVsbG8="}
+type execArg struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// decodeArgs converts the JSON arguments of cmd into the values sent to the
+// broadcast server. Strings and binary data are literal, their glob
+// characters are escaped so the server never expands them (file contents
+// excepted).
+func decodeArgs(cmd string, raw []json.RawMessage) ([]interface{}, error) {
+	args := make([]interface{}, len(raw))
+	for i, r := range raw {
+		arg, err := decodeArg(r)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %v", i+1, err)
+		}
+		args[i] = arg
+	}
+	literalContent(cmd, args)
+	return args, nil
+}
+
+// literalContent removes the escaping of the file contents argument of cmd,
+// contents are written as they are sent and never expanded
+func literalContent(cmd string, args []interface{}) {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i], _ = arg.(string)
+	}
+	i := glob.ContentArg(cmd, strs)
+	if i < 0 {
+		return
+	}
+	switch arg := args[i].(type) {
+	case string:
+		args[i] = glob.Unescape(arg)
+	case []byte:
+		args[i] = []byte(glob.Unescape(string(arg)))
+	}
+}
+
+func decodeArg(raw json.RawMessage) (interface{}, error) {
+	var v interface{}
+	if err := decodeJson(raw, &v); err != nil {
+		return nil, err
+	}
+
+	switch v := v.(type) {
+	case string:
+		return glob.Escape(v), nil
+	case json.Number:
+		return decodeNumber(v)
+	case bool:
+		return v, nil
+	case map[string]interface{}:
+		arg := execArg{}
+		if err := json.Unmarshal(raw, &arg); err != nil {
+			return nil, err
+		}
+		return arg.decode()
+	}
+	return nil, errors.New("unsupported argument " + string(raw))
+}
+
+func (arg *execArg) decode() (interface{}, error) {
+	var v interface{}
+	if err := decodeJson(arg.Value, &v); err != nil {
+		return nil, errors.New("missing or invalid value")
+	}
+
+	typ := strings.ToLower(arg.Type)
+	switch typ {
+	case "", "string":
+		if s, ok := v.(string); ok {
+			return glob.Escape(s), nil
+		}
+	case "glob":
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	case "int", "float":
+		n, ok := v.(json.Number)
+		if !ok {
+			break
+		}
+		if typ == "float" {
+			return n.Float64()
+		}
+		return n.Int64()
+	case "bool":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case "base64":
+		s, ok := v.(string)
+		if !ok {
+			break
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, errors.New("invalid base64 value")
+		}
+		return []byte(glob.Escape(string(b))), nil
+	default:
+		return nil, errors.New("unknown argument type " + arg.Type)
+	}
+	return nil, errors.New("value is not a valid " + arg.Type)
+}
+
+// decodeNumber keeps integers as integers so they are sent to the server unchanged
+func decodeNumber(n json.Number) (interface{}, error) {
+	if i, err := n.Int64(); err == nil {
+		return i, nil
+	}
+	return n.Float64()
+}
+
+func decodeJson(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
@@ -0,0 +1,37 @@
+package webterm
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeArg(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want interface{}
+	}{
+		{`"notes.txt"`, "notes.txt"},
+		{`"*.go"`, `\*.go`},
+		{`{"type": "glob", "value": "*.go"}`, "*.go"},
+		{`3`, int64(3)},
+		{`true`, true},
+		{`{"type": "int", "value": 2}`, int64(2)},
+		{`{"type": "float", "value": 2}`, float64(2)},
+		{`{"type": "FLOAT", "value": 1.5}`, 1.5},
+		{`{"type": "Float", "value": 2}`, float64(2)},
+		{`{"type": "BASE64", "value": "aGk="}`, []byte("hi")},
+	}
+	for _, test := range tests {
+		got, err := decodeArg(json.RawMessage(test.raw))
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("decodeArg(%s) = %#v, %v, want %#v", test.raw, got, err, test.want)
+		}
+	}
+
+	for _, raw := range []string{`{"type": "int", "value": "2"}`, `{"type": "date", "value": 1}`, `null`} {
+		if got, err := decodeArg(json.RawMessage(raw)); err == nil {
+			t.Errorf("decodeArg(%s) = %#v, want an error", raw, got)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package webterm
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// assetDirs are the directories of the app served as static files
+var assetDirs = []string{"scripts", "styles", "font"}
+
+// assetMaxAge is how long browsers may cache the embedded assets for before
+// checking their etag again
+const assetMaxAge = "public, max-age=3600"
+
+//go:embed app
+var embeddedApp embed.FS
+
+// Assets holds the web ui, either the copy embedded in the binary or a
+// directory on disk which is read again on every request (for development)
+type Assets struct {
+	files fs.FS
+	dev   bool
+	index *template.Template
+	etags map[string]string
+}
+
+// NewAssets returns the embedded assets, or those of dir when it is set. The
+// embedded templates are parsed (and every asset hashed) once up front.
+func NewAssets(dir string) (*Assets, error) {
+	assets := new(Assets)
+	if dir != "" {
+		if _, err := os.Stat(path.Join(dir, "index.html")); err != nil {
+			return nil, err
+		}
+		assets.files = os.DirFS(dir)
+		assets.dev = true
+		return assets, nil
+	}
+
+	files, err := fs.Sub(embeddedApp, "app")
+	if err != nil {
+		return nil, err
+	}
+	assets.files = files
+	if assets.index, err = template.ParseFS(files, "index.html"); err != nil {
+		return nil, err
+	}
+	assets.etags = make(map[string]string)
+	for _, dir := range assetDirs {
+		err := fs.WalkDir(files, dir, func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			f, err := files.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			sum := sha256.New()
+			if _, err := io.Copy(sum, f); err != nil {
+				return err
+			}
+			assets.etags[name] = `"` + hex.EncodeToString(sum.Sum(nil)[:16]) + `"`
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return assets, nil
+}
+
+// Index returns the template of the terminal page (which is also the login page)
+func (assets *Assets) Index() (*template.Template, error) {
+	if assets.dev {
+		return template.ParseFS(assets.files, "index.html")
+	}
+	return assets.index, nil
+}
+
+// Handler serves the static files of one of the asset directories under prefix
+func (assets *Assets) Handler(prefix, dir string) http.Handler {
+	files, err := fs.Sub(assets.files, dir)
+	if err != nil {
+		return http.NotFoundHandler()
+	}
+	fileServer := http.StripPrefix(prefix, http.FileServer(http.FS(files)))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if assets.dev {
+			w.Header().Set("Cache-Control", "no-cache")
+		} else if etag, ok := assets.etags[path.Join(dir, strings.TrimPrefix(req.URL.Path, prefix))]; ok {
+			// the file server answers If-None-Match against the etag set here
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Cache-Control", assetMaxAge)
+		}
+		fileServer.ServeHTTP(w, req)
+	})
+}
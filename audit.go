@@ -0,0 +1,105 @@
+package webterm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nyxtom/webterm/audit"
+)
+
+// defaultAuditTail and maxAuditTail bound the number of records shown by audit tail
+const defaultAuditTail = 20
+const maxAuditTail = 1000
+
+// errNoBackendAudit is the reply of the broadcast server when it keeps no audit log itself
+const errNoBackendAudit = "audit: no audit log is configured"
+
+// record writes a command run for a browser to the audit log, counting it in
+// the command metrics along the way
+func (handler *Handler) record(session *Session, remoteAddr string, resp *execResponse) {
+	handler.observe(resp)
+	if handler.audit == nil {
+		return
+	}
+	args := make([]string, len(resp.Args))
+	for i, arg := range resp.Args {
+		if b, ok := arg.([]byte); ok {
+			args[i] = string(b)
+		} else {
+			args[i] = fmt.Sprint(arg)
+		}
+	}
+	rec := &audit.Record{
+		Time:       resp.start,
+		Source:     "web",
+		RemoteAddr: remoteAddr,
+		Command:    strings.ToLower(resp.Cmd),
+		Args:       audit.RedactArgs(resp.Cmd, args),
+		Status:     "ok",
+		DurationMs: float64(time.Since(resp.start)) / float64(time.Millisecond),
+	}
+	if session != nil {
+		rec.User = session.User
+		rec.Session = session.ID
+	}
+	if resp.Error != nil {
+		rec.Status = resp.Error.Code
+		rec.Error = resp.Error.Message
+	}
+	if err := handler.audit.Write(rec); err != nil {
+		handler.LogErr(err)
+	}
+}
+
+// mergeAudit adds the records of the web server to the reply of audit tail,
+// which only holds those of the broadcast server
+func (handler *Handler) mergeAudit(resp *execResponse) {
+	if handler.audit == nil {
+		return
+	}
+	if resp.Error != nil && !strings.HasPrefix(resp.Error.Message, errNoBackendAudit) {
+		return
+	}
+
+	n := defaultAuditTail
+	if len(resp.Args) > 1 {
+		if i, err := strconv.Atoi(fmt.Sprint(resp.Args[1])); err == nil && i > 0 {
+			n = i
+		}
+	}
+	if n > maxAuditTail {
+		n = maxAuditTail
+	}
+
+	records := []*audit.Record{}
+	if resp.Error == nil {
+		// the reply went through json once already, decode it back into records
+		if reply, ok := resp.Reply.(map[string]interface{}); ok {
+			if js, err := json.Marshal(reply["records"]); err == nil {
+				json.Unmarshal(js, &records)
+			}
+		}
+	}
+	local, err := handler.audit.Tail(n)
+	if err != nil {
+		handler.LogErr(err)
+		resp.fail(newExecError(http.StatusInternalServerError, "audit_error", "unable to read the audit log"))
+		return
+	}
+
+	records = append(records, local...)
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	if len(records) > n {
+		records = records[len(records)-n:]
+	}
+	resp.OK = true
+	resp.Error = nil
+	resp.Reply = map[string]interface{}{"records": records}
+}
@@ -0,0 +1,194 @@
+// Package audit keeps an append-only log of every command run through webterm,
+// one json record per line, rotated once the file grows past a size.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nyxtom/webterm/glob"
+)
+
+// maxArgLen is the longest argument recorded as is, longer ones are hashed
+const maxArgLen = 256
+
+// Record is a single command in the audit log
+type Record struct {
+	Time       time.Time `json:"time"`
+	Source     string    `json:"source"` // web or broadcast
+	User       string    `json:"user,omitempty"`
+	Session    string    `json:"session,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Command    string    `json:"cmd"`
+	Args       []string  `json:"args,omitempty"`
+	Status     string    `json:"status"` // ok or the error code
+	Error      string    `json:"error,omitempty"`
+	DurationMs float64   `json:"duration_ms"`
+}
+
+// Logger appends records to the audit file, a nil logger records nothing
+type Logger struct {
+	sync.Mutex
+
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// Open opens (or creates) the audit file at path, once it reaches maxSize
+// bytes it is renamed to path.1 (and so on up to maxBackups) and a new file is started
+func Open(path string, maxSize int64, maxBackups int) (*Logger, error) {
+	l := &Logger{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Logger) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// Write appends the record to the log
+func (l *Logger) Write(rec *Record) error {
+	if l == nil {
+		return nil
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.Lock()
+	defer l.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// rotate shifts the backups up by one and starts a new file, the lock must be held
+func (l *Logger) rotate() error {
+	l.file.Close()
+	if l.maxBackups > 0 {
+		os.Remove(l.backup(l.maxBackups))
+		for i := l.maxBackups - 1; i >= 1; i-- {
+			os.Rename(l.backup(i), l.backup(i+1))
+		}
+		if err := os.Rename(l.path, l.backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func (l *Logger) backup(i int) string {
+	return l.path + "." + strconv.Itoa(i)
+}
+
+// Tail returns the last n records, oldest first, reading into the most recent
+// backup when the current file holds fewer
+func (l *Logger) Tail(n int) ([]*Record, error) {
+	if l == nil || n <= 0 {
+		return []*Record{}, nil
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	records := []*Record{}
+	for _, p := range []string{l.path, l.backup(1)} {
+		recs, err := readRecords(p)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		records = append(recs, records...)
+		if len(records) >= n {
+			break
+		}
+	}
+	if len(records) > n {
+		records = records[len(records)-n:]
+	}
+	return records, nil
+}
+
+func readRecords(path string) ([]*Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := []*Record{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		rec := &Record{}
+		if json.Unmarshal(scanner.Bytes(), rec) == nil {
+			records = append(records, rec)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// Close closes the audit file
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	return l.file.Close()
+}
+
+// RedactArgs returns the arguments as recorded in the log, file contents
+// (the content of save and any long, multi-line or binary argument) are
+// replaced by their hash and size and the secret of identify is left out
+func RedactArgs(cmd string, args []string) []string {
+	redacted := make([]string, len(args))
+	content := glob.ContentArg(cmd, args)
+	for i, arg := range args {
+		if i == 0 && strings.EqualFold(cmd, "identify") {
+			redacted[i] = "(secret)"
+		} else if i == content || len(arg) > maxArgLen || strings.ContainsAny(arg, "\r\n") || !utf8.ValidString(arg) {
+			redacted[i] = Hash(arg)
+		} else {
+			redacted[i] = arg
+		}
+	}
+	return redacted
+}
+
+// Hash describes content by its sha256 and size without revealing it
+func Hash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(sum[:8]) + " (" + strconv.Itoa(len(content)) + " bytes)"
+}
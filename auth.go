@@ -0,0 +1,299 @@
+package webterm
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sessionCookie is the name of the cookie holding the signed session
+const sessionCookie = "webterm_session"
+
+// ErrBadLogin is returned for an unknown user or a wrong password, which of the two is never told
+var ErrBadLogin = errors.New("invalid username or password")
+
+// ErrNoSession is returned when a request carries no valid session
+var ErrNoSession = errors.New("not logged in")
+
+// dummyHash is compared against for unknown users so they take as long to reject as known ones
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("webterm"), bcrypt.DefaultCost)
+
+// User is an account of the users file
+//
+//	[[user]]
+//	name = "tom"
+//	password = "$2a$10$..." # bcrypt hash, see webterm --hash_password
+//	roles = ["admin"]
+type User struct {
+	Name     string   `toml:"name"`
+	Password string   `toml:"password"`
+	Roles    []string `toml:"roles"`
+}
+
+type usersFile struct {
+	Users []*User `toml:"user"`
+}
+
+// Session is a logged in browser
+type Session struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	RemoteAddr string    `json:"remote_addr"`
+	Created    time.Time `json:"created"`
+	Expires    time.Time `json:"expires"`
+	LastSeen   time.Time `json:"last_seen"`
+}
+
+// Auth holds the user accounts and the sessions logged in with them
+type Auth struct {
+	sync.Mutex
+
+	users    map[string]*User
+	sessions map[string]*Session
+	secret   []byte
+	ttl      time.Duration
+}
+
+// NewAuth loads the users file, sessions are signed with secret or with a
+// random key when no secret is given (sessions are then lost on restart)
+func NewAuth(usersPath, secret string, ttl time.Duration) (*Auth, error) {
+	data, err := ioutil.ReadFile(usersPath)
+	if err != nil {
+		return nil, err
+	}
+	file := &usersFile{}
+	if _, err := toml.Decode(string(data), file); err != nil {
+		return nil, errors.New(usersPath + ": " + err.Error())
+	}
+
+	auth := new(Auth)
+	auth.users = make(map[string]*User)
+	auth.sessions = make(map[string]*Session)
+	auth.ttl = ttl
+	for _, u := range file.Users {
+		if u.Name == "" || u.Password == "" {
+			return nil, errors.New(usersPath + ": every user needs a name and a password")
+		}
+		if _, err := bcrypt.Cost([]byte(u.Password)); err != nil {
+			return nil, errors.New(usersPath + ": password of " + u.Name + " is not a bcrypt hash")
+		}
+		auth.users[u.Name] = u
+	}
+
+	if secret != "" {
+		auth.secret = []byte(secret)
+	} else {
+		auth.secret = make([]byte, 32)
+		if _, err := rand.Read(auth.secret); err != nil {
+			return nil, err
+		}
+	}
+	return auth, nil
+}
+
+// HashPassword returns the bcrypt hash of a password as stored in the users file
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Login checks the password of the user and starts a new session
+func (auth *Auth) Login(name, password, remoteAddr string) (*Session, error) {
+	auth.Lock()
+	user, ok := auth.users[name]
+	auth.Unlock()
+
+	hash := dummyHash
+	if ok {
+		hash = []byte(user.Password)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !ok {
+		return nil, ErrBadLogin
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	session := &Session{
+		ID:         hex.EncodeToString(id),
+		User:       name,
+		RemoteAddr: remoteAddr,
+		Created:    now,
+		Expires:    now.Add(auth.ttl),
+		LastSeen:   now,
+	}
+
+	auth.Lock()
+	auth.sweep(now)
+	auth.sessions[session.ID] = session
+	auth.Unlock()
+	return session, nil
+}
+
+// CertSession returns the session of a verified client certificate issued to
+// the user name, the session is started on the first request made with the
+// certificate and lasts as long as a login does
+func (auth *Auth) CertSession(name, fingerprint, remoteAddr string) *Session {
+	auth.Lock()
+	defer auth.Unlock()
+	if _, ok := auth.users[name]; !ok {
+		return nil
+	}
+
+	now := time.Now()
+	id := "cert-" + fingerprint[:32]
+	if session, ok := auth.sessions[id]; ok && now.Before(session.Expires) && session.User == name {
+		session.LastSeen = now
+		return session
+	}
+	session := &Session{
+		ID:         id,
+		User:       name,
+		RemoteAddr: remoteAddr,
+		Created:    now,
+		Expires:    now.Add(auth.ttl),
+		LastSeen:   now,
+	}
+	auth.sweep(now)
+	auth.sessions[id] = session
+	return session
+}
+
+// User returns the account of a session
+func (auth *Auth) User(session *Session) *User {
+	auth.Lock()
+	defer auth.Unlock()
+	return auth.users[session.User]
+}
+
+// Session returns the session of a cookie value, the cookie must be signed by
+// us, unexpired and not revoked
+func (auth *Auth) Session(cookie string) (*Session, error) {
+	id, expires, ok := auth.verify(cookie)
+	if !ok || time.Now().After(expires) {
+		return nil, ErrNoSession
+	}
+
+	auth.Lock()
+	defer auth.Unlock()
+	session, ok := auth.sessions[id]
+	if !ok || time.Now().After(session.Expires) {
+		return nil, ErrNoSession
+	}
+	session.LastSeen = time.Now()
+	return session, nil
+}
+
+// Valid reports whether the session is still logged in
+func (auth *Auth) Valid(session *Session) bool {
+	auth.Lock()
+	defer auth.Unlock()
+	_, ok := auth.sessions[session.ID]
+	return ok && time.Now().Before(session.Expires)
+}
+
+// Sessions returns the sessions of the user, sorted with the most recent first
+func (auth *Auth) Sessions(user string) []Session {
+	auth.Lock()
+	defer auth.Unlock()
+	auth.sweep(time.Now())
+	sessions := []Session{}
+	for _, s := range auth.sessions {
+		if s.User == user {
+			sessions = append(sessions, *s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created.After(sessions[j].Created)
+	})
+	return sessions
+}
+
+// Count returns the number of sessions logged in
+func (auth *Auth) Count() int {
+	auth.Lock()
+	defer auth.Unlock()
+	auth.sweep(time.Now())
+	return len(auth.sessions)
+}
+
+// Revoke logs out the session with the given id if it belongs to user
+func (auth *Auth) Revoke(user, id string) bool {
+	auth.Lock()
+	defer auth.Unlock()
+	session, ok := auth.sessions[id]
+	if !ok || session.User != user {
+		return false
+	}
+	delete(auth.sessions, id)
+	return true
+}
+
+// Cookie returns the signed cookie value of a session
+func (auth *Auth) Cookie(session *Session) string {
+	payload := session.ID + "." + strconv.FormatInt(session.Expires.Unix(), 10)
+	return payload + "." + auth.sign(payload)
+}
+
+func (auth *Auth) verify(cookie string) (string, time.Time, bool) {
+	i := strings.LastIndex(cookie, ".")
+	if i < 0 {
+		return "", time.Time{}, false
+	}
+	payload, sig := cookie[:i], cookie[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(auth.sign(payload))) {
+		return "", time.Time{}, false
+	}
+	parts := strings.SplitN(payload, ".", 2)
+	if len(parts) != 2 {
+		return "", time.Time{}, false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return parts[0], time.Unix(expires, 0), true
+}
+
+func (auth *Auth) sign(payload string) string {
+	mac := hmac.New(sha256.New, auth.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sweep drops the expired sessions, the lock must be held
+func (auth *Auth) sweep(now time.Time) {
+	for id, s := range auth.sessions {
+		if now.After(s.Expires) {
+			delete(auth.sessions, id)
+		}
+	}
+}
+
+type sessionKey struct{}
+
+// withSession returns a copy of the context carrying the session
+func withSession(ctx context.Context, session *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
+}
+
+// sessionOf returns the session of a request that passed requireSession, nil when authentication is disabled
+func sessionOf(ctx context.Context) *Session {
+	session, _ := ctx.Value(sessionKey{}).(*Session)
+	return session
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nyxtom/broadcast/server"
+	"github.com/nyxtom/webterm/audit"
+)
+
+const auditUsage = "audit tail [n]"
+
+// defaultAuditTail and maxAuditTail bound the number of records shown by audit tail
+const defaultAuditTail = 20
+const maxAuditTail = 1000
+
+// AuditTail is the reply of audit tail
+type AuditTail struct {
+	Records []*audit.Record `json:"records"`
+}
+
+// PipeText renders the records one per line inside of a pipeline
+func (a *AuditTail) PipeText() []byte {
+	var out bytes.Buffer
+	for _, r := range a.Records {
+		out.WriteString(formatRecord(r) + "\n")
+	}
+	return out.Bytes()
+}
+
+func formatRecord(r *audit.Record) string {
+	user := r.User
+	if user == "" {
+		user = "-"
+	}
+	line := fmt.Sprintf("%s %s %s %s %s", r.Time.Format(time.RFC3339), r.Source, user, r.RemoteAddr, r.Command)
+	for _, arg := range r.Args {
+		line += " " + strconv.Quote(arg)
+	}
+	line += fmt.Sprintf(" -> %s (%.1fms)", r.Status, r.DurationMs)
+	return line
+}
+
+// auditClient stands in for the protocol client while an audited command
+// runs, remembering the error the command replied with
+type auditClient struct {
+	server.ProtocolClient
+
+	err error
+}
+
+func (a *auditClient) WriteError(err error) error {
+	a.err = err
+	return a.ProtocolClient.WriteError(err)
+}
+
+// audited wraps the handler of a command so that every run is recorded. The
+// commands of connections identified by the web server are recorded by the
+// web server (which knows the browser session and address), so each command
+// is only recorded once. identify itself is always recorded here since the
+// web server never records it.
+func (t *TermBackend) audited(name string, handler func(interface{}, server.ProtocolClient) error) func(interface{}, server.ProtocolClient) error {
+	return func(data interface{}, client server.ProtocolClient) error {
+		if t.audit == nil {
+			return handler(data, client)
+		}
+		if _, _, trusted := t.sessions.Get(client).Identity(); trusted && name != "identify" {
+			return handler(data, client)
+		}
+
+		start := time.Now()
+		ac := &auditClient{ProtocolClient: client}
+		herr := handler(data, ac)
+		err := herr
+		if err == nil {
+			err = ac.err
+		}
+
+		d, _ := data.([][]byte)
+		args := make([]string, len(d))
+		for i, arg := range d {
+			args[i] = string(arg)
+		}
+		rec := &audit.Record{
+			Time:       start,
+			Source:     "broadcast",
+			Command:    name,
+			Args:       audit.RedactArgs(name, args),
+			Status:     "ok",
+			DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+		}
+		rec.User, _, _ = t.sessions.Get(client).Identity()
+		if addr := client.RemoteAddr(); addr != nil {
+			rec.RemoteAddr = addr.String()
+		}
+		if err != nil {
+			rec.Status = "error"
+			rec.Error = err.Error()
+		}
+		if werr := t.audit.Write(rec); werr != nil {
+			select {
+			case t.app.Events <- server.BroadcastEvent{Level: "error", Message: "unable to write the audit log", Err: werr}:
+			default:
+			}
+		}
+		return herr
+	}
+}
+
+// Audit shows the most recent records of the audit log
+func (t *TermBackend) Audit(data interface{}, client server.ProtocolClient) error {
+	d, _ := data.([][]byte)
+	if len(d) == 0 || string(d[0]) != "tail" || len(d) > 2 {
+		t.writeError(client, errors.New("audit takes a subcommand ("+auditUsage+")"))
+		return nil
+	}
+	if t.audit == nil {
+		t.writeError(client, errors.New("audit: no audit log is configured"))
+		return nil
+	}
+
+	n := defaultAuditTail
+	if len(d) == 2 {
+		var err error
+		n, err = strconv.Atoi(string(d[1]))
+		if err != nil || n <= 0 {
+			t.writeError(client, errors.New("audit: invalid number of records "+string(d[1])))
+			return nil
+		}
+		if n > maxAuditTail {
+			n = maxAuditTail
+		}
+	}
+
+	records, err := t.audit.Tail(n)
+	if err != nil {
+		t.writeError(client, errors.New("audit: unable to read the audit log"))
+		return nil
+	}
+	client.WriteJson(&AuditTail{records})
+	client.Flush()
+	return nil
+}
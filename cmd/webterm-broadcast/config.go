@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// envPrefix starts the name of the environment variable of every config key,
+// nested keys are joined with _ (backends.term is WEBTERM_BACKENDS_TERM)
+const envPrefix = "WEBTERM_"
+
+// Configuration is the config file of webterm-broadcast. Every key can also be
+// set with an environment variable or a flag, flags win over the environment
+// which wins over the file.
+//
+//	host = "127.0.0.1"
+//	port = 7337
+//	protocol = "redis"
+//	homedir = "/srv/webterm"
+//
+//	[sandbox]
+//	follow_symlinks = true
+//	allow_fs_root = false
+//
+//	[backends]
+//	default = true
+//	term = true
+type Configuration struct {
+	Host     string `toml:"host"`     // host of the server
+	Port     int    `toml:"port"`     // port of the server
+	Protocol string `toml:"protocol"` // broadcast protocol, redis or line (empty for the broadcast default)
+
+	HomeDir      string `toml:"homedir"`       // directory served to clients, the current user's home when empty
+	ResumeFile   string `toml:"resume_file"`   // greeting file in the home directory (markdown or text)
+	ResumeCmd    string `toml:"resume_cmd"`    // command showing the greeting, empty to disable
+	HistoryLimit int    `toml:"history_limit"` // revisions kept of every saved file, 0 to keep none
+	PolicyFile   string `toml:"policy_file"`   // toml file with the [policy] of the web server
+
+	AuditFile       string `toml:"audit_file"`        // append-only audit log of direct connections
+	AuditMaxSize    int64  `toml:"audit_max_size"`    // size in bytes at which the audit log is rotated
+	AuditMaxBackups int    `toml:"audit_max_backups"` // number of rotated audit logs kept
+
+	LogFile    string `toml:"log_file"`    // file events are appended to, stdout when empty
+	CPUProfile string `toml:"cpu_profile"` // file the cpu profile is written to, disabled when empty
+	StatsAddr  string `toml:"stats_addr"`  // address serving /metrics, disabled when empty
+
+	Sandbox  SandboxConfig  `toml:"sandbox"`
+	Backends BackendsConfig `toml:"backends"`
+}
+
+// BackendsConfig enables the backends whose commands are registered
+type BackendsConfig struct {
+	Default bool `toml:"default"` // ping, echo, info and cmds
+	Term    bool `toml:"term"`    // the file commands of the home directory
+}
+
+// DefaultConfig returns the configuration used for keys set nowhere else
+func DefaultConfig() *Configuration {
+	return &Configuration{
+		Host:            "127.0.0.1",
+		Port:            7337,
+		Protocol:        "redis",
+		ResumeFile:      "resume.md",
+		ResumeCmd:       "resume",
+		HistoryLimit:    defaultHistoryLimit,
+		AuditMaxSize:    10 << 20,
+		AuditMaxBackups: 5,
+		Sandbox:         SandboxConfig{FollowSymlinks: true},
+		Backends:        BackendsConfig{Default: true, Term: true},
+	}
+}
+
+// configFlags maps the flags to the config keys they set
+var configFlags = map[string]string{
+	"h":                 "host",
+	"p":                 "port",
+	"bprotocol":         "protocol",
+	"homedir":           "homedir",
+	"resume":            "resume_file",
+	"resumecmd":         "resume_cmd",
+	"history_limit":     "history_limit",
+	"policy":            "policy_file",
+	"audit":             "audit_file",
+	"audit_max_size":    "audit_max_size",
+	"audit_max_backups": "audit_max_backups",
+	"log_file":          "log_file",
+	"cpuprofile":        "cpu_profile",
+	"stats_addr":        "stats_addr",
+	"follow_symlinks":   "sandbox.follow_symlinks",
+	"allow_fs_root":     "sandbox.allow_fs_root",
+	"backend_default":   "backends.default",
+	"backend_term":      "backends.term",
+}
+
+// attachConfigFlags defines a flag for every config key, showing the defaults
+func attachConfigFlags(def *Configuration) {
+	flag.String("h", def.Host, "webterm host to bind to")
+	flag.Int("p", def.Port, "webterm port to bind to")
+	flag.String("bprotocol", def.Protocol, "Broadcast protocol configuration")
+	flag.String("homedir", def.HomeDir, "home directory to serve static files")
+	flag.String("resume", def.ResumeFile, "greeting file in the home directory (markdown or text)")
+	flag.String("resumecmd", def.ResumeCmd, "name of the command showing the greeting (e.g. motd), empty to disable")
+	flag.Int("history_limit", def.HistoryLimit, "number of revisions kept of every saved file, 0 to keep none")
+	flag.String("policy", def.PolicyFile, "toml file with the [policy] of the web server (e.g. its config file), commands are unrestricted without one")
+	flag.String("audit", def.AuditFile, "append-only audit log of the commands run by direct connections (json lines)")
+	flag.Int64("audit_max_size", def.AuditMaxSize, "size in bytes at which the audit log is rotated")
+	flag.Int("audit_max_backups", def.AuditMaxBackups, "number of rotated audit logs kept")
+	flag.String("log_file", def.LogFile, "file the server events are appended to, stdout when empty")
+	flag.String("cpuprofile", def.CPUProfile, "write cpu profile to file")
+	flag.String("stats_addr", def.StatsAddr, "address serving the command metrics at /metrics (e.g. 127.0.0.1:7338), disabled when empty")
+	flag.Bool("follow_symlinks", def.Sandbox.FollowSymlinks, "follow symlinks in the home directory as long as they stay inside of it")
+	flag.Bool("allow_fs_root", def.Sandbox.AllowFSRoot, "allow the root of the filesystem as the home directory")
+	flag.Bool("backend_default", def.Backends.Default, "register the default broadcast commands (ping, echo, info, cmds)")
+	flag.Bool("backend_term", def.Backends.Term, "register the term commands of the home directory")
+}
+
+// LoadConfig returns the defaults overridden by the config file (when given),
+// the environment and then the flags set on the command line
+func LoadConfig(configFile string) (*Configuration, error) {
+	cfg := DefaultConfig()
+	fields := configFields(cfg)
+
+	if configFile != "" {
+		data, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+		md, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return nil, errors.New(configFile + ": " + err.Error())
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, key := range undecoded {
+				keys[i] = key.String()
+			}
+			return nil, errors.New(configFile + ": unknown keys " + strings.Join(keys, ", "))
+		}
+	}
+
+	for _, key := range sortedKeys(fields) {
+		name := envPrefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+		if value, ok := os.LookupEnv(name); ok {
+			if err := setField(fields[key], value); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		key, ok := configFlags[f.Name]
+		if !ok || err != nil {
+			return
+		}
+		if ferr := setField(fields[key], f.Value.String()); ferr != nil {
+			err = fmt.Errorf("-%s: %v", f.Name, ferr)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// Validate checks the values of the configuration
+func (cfg *Configuration) Validate() error {
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		return fmt.Errorf("invalid port %d", cfg.Port)
+	}
+	switch cfg.Protocol {
+	case "", "redis", "line":
+	default:
+		return errors.New("Invalid protocol " + cfg.Protocol + " specified")
+	}
+	if cfg.HistoryLimit < 0 {
+		return fmt.Errorf("invalid history_limit %d", cfg.HistoryLimit)
+	}
+	if cfg.AuditFile != "" && (cfg.AuditMaxSize <= 0 || cfg.AuditMaxBackups < 0) {
+		return errors.New("audit_max_size must be positive and audit_max_backups can not be negative")
+	}
+	if !cfg.Backends.Default && !cfg.Backends.Term {
+		return errors.New("no backends enabled")
+	}
+	return nil
+}
+
+// Print writes the configuration in the format of the config file
+func (cfg *Configuration) Print() error {
+	return toml.NewEncoder(os.Stdout).Encode(cfg)
+}
+
+// configFields returns the fields of the configuration by key, nested keys
+// are joined with a dot
+func configFields(cfg *Configuration) map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			key := prefix + v.Type().Field(i).Tag.Get("toml")
+			if v.Field(i).Kind() == reflect.Struct {
+				walk(key+".", v.Field(i))
+			} else {
+				fields[key] = v.Field(i)
+			}
+		}
+	}
+	walk("", reflect.ValueOf(cfg).Elem())
+	return fields
+}
+
+func sortedKeys(fields map[string]reflect.Value) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// setField parses value into a field of the configuration
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.New("invalid number " + strconv.Quote(value))
+		}
+		field.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("invalid boolean " + strconv.Quote(value))
+		}
+		field.SetBool(b)
+	default:
+		return errors.New("unsupported type " + field.Kind().String())
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/nyxtom/broadcast/server"
+	"github.com/nyxtom/webterm/glob"
+)
+
+// ServerInfo is the reply of info
+type ServerInfo struct {
+	Name          string  `json:"name"`
+	Version       string  `json:"version"`
+	Pid           int     `json:"pid"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	Clients       int     `json:"clients"`
+	Goroutines    int     `json:"goroutines"`
+	MemoryBytes   uint64  `json:"memory_bytes"`
+}
+
+// registerDefaults registers ping, echo, info and cmds in place of the default
+// broadcast backend so that they go through the policy, the audit log and the
+// command metrics like every other command
+func (t *TermBackend) registerDefaults() {
+	t.registerCommand(server.Command{"ping", "Pings the server for a response", "", false}, t.Ping)
+	t.registerCommand(server.Command{"echo", "Echos back a message sent", "echo \"hello world\"", false}, t.Echo)
+	t.registerCommand(server.Command{"info", "Current server status and information", "", false}, t.Info)
+	t.registerCommand(server.Command{"cmds", "List of available commands supported by the server", "", false}, t.Cmds)
+}
+
+func (t *TermBackend) Ping(data interface{}, client server.ProtocolClient) error {
+	client.WriteString("PONG")
+	client.Flush()
+	return nil
+}
+
+func (t *TermBackend) Echo(data interface{}, client server.ProtocolClient) error {
+	d, _ := data.([][]byte)
+	parts := make([]string, len(d))
+	for i, arg := range d {
+		// clients escape the glob characters of quoted arguments
+		parts[i] = glob.Unescape(string(arg))
+	}
+	client.WriteString(strings.Join(parts, " "))
+	client.Flush()
+	return nil
+}
+
+func (t *TermBackend) Info(data interface{}, client server.ProtocolClient) error {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	client.WriteJson(&ServerInfo{
+		Name:          t.app.Name,
+		Version:       t.app.Version,
+		Pid:           os.Getpid(),
+		UptimeSeconds: time.Since(t.metrics.start).Seconds(),
+		Clients:       t.metrics.Clients(),
+		Goroutines:    runtime.NumGoroutine(),
+		MemoryBytes:   mem.Alloc,
+	})
+	client.Flush()
+	return nil
+}
+
+// Cmds lists every registered command by its upper case name
+func (t *TermBackend) Cmds(data interface{}, client server.ProtocolClient) error {
+	client.WriteJson(t.help)
+	client.Flush()
+	return nil
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nyxtom/broadcast/server"
+	"github.com/nyxtom/webterm/glob"
+)
+
+// ErrRootDir is returned when a command would modify the home directory itself
+var ErrRootDir = errors.New("refusing to operate on the home directory")
+
+// PathErrors collects the per path failures of a command that operates on several paths
+type PathErrors []error
+
+func (e PathErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// parseFlags splits the arguments of op into single letter flags and operands,
+// only the letters in allowed are accepted as flags
+func parseFlags(op string, d [][]byte, allowed string) (map[rune]bool, []string, error) {
+	flags := make(map[rune]bool)
+	args := []string{}
+	done := false
+	for _, arg := range d {
+		a := string(arg)
+		if done || len(a) < 2 || a[0] != '-' {
+			args = append(args, a)
+			continue
+		}
+		if a == "--" {
+			done = true
+			continue
+		}
+		for _, c := range a[1:] {
+			if !strings.ContainsRune(allowed, c) {
+				return nil, nil, errors.New(op + ": invalid option -- '" + string(c) + "'")
+			}
+			flags[c] = true
+		}
+	}
+	return flags, args, nil
+}
+
+// writeResult replies with the summary when every path succeeded, otherwise
+// with the list of per path errors (successful paths are still applied)
+func (t *TermBackend) writeResult(client server.ProtocolClient, errs PathErrors, summary string) {
+	if len(errs) > 0 {
+		t.writeError(client, errs)
+		return
+	}
+	client.WriteString(summary)
+	client.Flush()
+}
+
+func (t *TermBackend) MakeDir(data interface{}, client server.ProtocolClient) error {
+	d, _ := data.([][]byte)
+	flags, args, err := parseFlags("mkdir", d, "p")
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+	if len(args) == 0 {
+		t.writeError(client, errors.New("mkdir takes at least 1 parameter (mkdir [-p] dir...)"))
+		return nil
+	}
+
+	errs := PathErrors{}
+	for _, name := range args {
+		fullPath, err := t.resolve(client, "mkdir", name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if t.sandbox.IsRoot(fullPath) {
+			errs = append(errs, &PathError{"mkdir", name, ErrRootDir})
+			continue
+		}
+		if flags['p'] {
+			err = os.MkdirAll(fullPath, 0755)
+		} else {
+			err = os.Mkdir(fullPath, 0755)
+		}
+		if err != nil {
+			errs = append(errs, newPathError("mkdir", name, err))
+		}
+	}
+
+	t.writeResult(client, errs, "created "+strings.Join(args, ", "))
+	return nil
+}
+
+func (t *TermBackend) RemoveFile(data interface{}, client server.ProtocolClient) error {
+	d, _ := data.([][]byte)
+	flags, args, err := parseFlags("rm", d, "r")
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+	args, err = t.expandArgs(client, "rm", args)
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+	if len(args) == 0 {
+		t.writeError(client, errors.New("rm takes at least 1 parameter (rm [-r] file...)"))
+		return nil
+	}
+
+	errs := PathErrors{}
+	for _, name := range args {
+		fullPath, err := t.resolveNoFollow(client, "rm", name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if t.sandbox.IsRoot(fullPath) {
+			errs = append(errs, &PathError{"rm", name, ErrRootDir})
+			continue
+		}
+		info, err := os.Lstat(fullPath)
+		if err != nil {
+			errs = append(errs, newPathError("rm", name, err))
+			continue
+		}
+		if info.IsDir() && !flags['r'] {
+			errs = append(errs, &PathError{"rm", name, errors.New("is a directory")})
+			continue
+		}
+		if info.IsDir() {
+			err = os.RemoveAll(fullPath)
+		} else {
+			err = os.Remove(fullPath)
+		}
+		if err != nil {
+			errs = append(errs, newPathError("rm", name, err))
+		}
+	}
+
+	t.writeResult(client, errs, "removed "+strings.Join(args, ", "))
+	return nil
+}
+
+func (t *TermBackend) MoveFile(data interface{}, client server.ProtocolClient) error {
+	d, _ := data.([][]byte)
+	_, args, err := parseFlags("mv", d, "")
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+	args, err = t.expandArgs(client, "mv", args)
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+	if len(args) < 2 {
+		t.writeError(client, errors.New("mv takes at least 2 parameters (mv source... dest)"))
+		return nil
+	}
+
+	sources, dest := args[:len(args)-1], args[len(args)-1]
+	destPath, destIsDir, err := t.resolveDest(client, "mv", dest, len(sources))
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+
+	errs := PathErrors{}
+	for _, name := range sources {
+		srcPath, err := t.resolveNoFollow(client, "mv", name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if t.sandbox.IsRoot(srcPath) {
+			errs = append(errs, &PathError{"mv", name, ErrRootDir})
+			continue
+		}
+		target, err := t.resolveTarget(client, "mv", destPath, destIsDir, srcPath)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if isWithin(target, srcPath) {
+			errs = append(errs, &PathError{"mv", name, errors.New("cannot move a directory into itself")})
+			continue
+		}
+		if err := os.Rename(srcPath, target); err != nil {
+			errs = append(errs, newPathError("mv", name, err))
+		}
+	}
+
+	t.writeResult(client, errs, "moved "+strings.Join(sources, ", ")+" to "+dest)
+	return nil
+}
+
+func (t *TermBackend) CopyFile(data interface{}, client server.ProtocolClient) error {
+	d, _ := data.([][]byte)
+	flags, args, err := parseFlags("cp", d, "r")
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+	args, err = t.expandArgs(client, "cp", args)
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+	if len(args) < 2 {
+		t.writeError(client, errors.New("cp takes at least 2 parameters (cp [-r] source... dest)"))
+		return nil
+	}
+
+	sources, dest := args[:len(args)-1], args[len(args)-1]
+	destPath, destIsDir, err := t.resolveDest(client, "cp", dest, len(sources))
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+
+	errs := PathErrors{}
+	for _, name := range sources {
+		srcPath, err := t.resolve(client, "cp", name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if t.sandbox.IsRoot(srcPath) {
+			errs = append(errs, &PathError{"cp", name, ErrRootDir})
+			continue
+		}
+		info, err := os.Stat(srcPath)
+		if err != nil {
+			errs = append(errs, newPathError("cp", name, err))
+			continue
+		}
+		target, err := t.resolveTarget(client, "cp", destPath, destIsDir, srcPath)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if target == srcPath {
+			errs = append(errs, &PathError{"cp", name, errors.New("source and destination are the same file")})
+			continue
+		}
+		if info.IsDir() {
+			if !flags['r'] {
+				errs = append(errs, &PathError{"cp", name, errors.New("is a directory (not copied)")})
+				continue
+			}
+			if isWithin(target, srcPath) {
+				errs = append(errs, &PathError{"cp", name, errors.New("cannot copy a directory into itself")})
+				continue
+			}
+			err = copyTree(srcPath, target, t.sandbox.Root())
+		} else {
+			err = copyFile(srcPath, target, info.Mode())
+		}
+		if err != nil {
+			errs = append(errs, newPathError("cp", name, err))
+		}
+	}
+
+	t.writeResult(client, errs, "copied "+strings.Join(sources, ", ")+" to "+dest)
+	return nil
+}
+
+func (t *TermBackend) TouchFile(data interface{}, client server.ProtocolClient) error {
+	d, _ := data.([][]byte)
+	_, args, err := parseFlags("touch", d, "")
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+	args, err = t.expandArgs(client, "touch", args)
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+	if len(args) == 0 {
+		t.writeError(client, errors.New("touch takes at least 1 parameter (touch file...)"))
+		return nil
+	}
+
+	errs := PathErrors{}
+	now := time.Now()
+	for _, name := range args {
+		fullPath, err := t.resolve(client, "touch", name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if t.sandbox.IsRoot(fullPath) {
+			errs = append(errs, &PathError{"touch", name, ErrRootDir})
+			continue
+		}
+		f, err := os.OpenFile(fullPath, os.O_CREATE|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			err = os.Chtimes(fullPath, now, now)
+		}
+		if err != nil {
+			errs = append(errs, newPathError("touch", name, err))
+		}
+	}
+
+	t.writeResult(client, errs, "touched "+strings.Join(args, ", "))
+	return nil
+}
+
+// resolveDest resolves the destination of mv or cp, reporting whether the
+// sources should be placed inside of it
+func (t *TermBackend) resolveDest(client server.ProtocolClient, op, dest string, sources int) (string, bool, error) {
+	destPath, err := t.resolve(client, op, dest)
+	if err != nil {
+		return "", false, err
+	}
+	info, err := os.Stat(destPath)
+	if err == nil && info.IsDir() {
+		return destPath, true, nil
+	}
+	if sources > 1 {
+		return "", false, &PathError{op, dest, errors.New("not a directory")}
+	}
+	if t.sandbox.IsRoot(destPath) {
+		return "", false, &PathError{op, dest, ErrRootDir}
+	}
+	return destPath, false, nil
+}
+
+// resolveTarget returns the path srcPath is moved or copied to, resolved
+// through the sandbox again (without following a symlink at the end) so that
+// the state directory and the paths the policy denies can not be written to.
+// An existing symlink is never written through.
+func (t *TermBackend) resolveTarget(client server.ProtocolClient, op, destPath string, destIsDir bool, srcPath string) (string, error) {
+	target := destPath
+	if destIsDir {
+		target = filepath.Join(destPath, filepath.Base(srcPath))
+	}
+	name := t.sandbox.Rel(target)
+	target, err := t.resolveNoFollow(client, op, glob.Escape(name))
+	if err != nil {
+		return "", err
+	}
+	if err := refuseSymlink(target); err != nil {
+		return "", &PathError{op, name, err}
+	}
+	return target, nil
+}
+
+// ErrSymlinkTarget is returned when a copy or move would write through a symlink
+var ErrSymlinkTarget = errors.New("destination is a symlink")
+
+// refuseSymlink fails when there is a symlink at fullPath
+func refuseSymlink(fullPath string) error {
+	if info, err := os.Lstat(fullPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return ErrSymlinkTarget
+	}
+	return nil
+}
+
+// isWithin reports whether target is dir or located somewhere below it
+func isWithin(target, dir string) bool {
+	return target == dir || strings.HasPrefix(target, dir+string(filepath.Separator))
+}
+
+// writeFileAtomic writes content to a temporary file next to fullPath, syncs
+// it to disk and renames it into place so that readers never see a partially
+// written file. The mode of an existing file is kept, otherwise perm is used.
+func writeFileAtomic(fullPath string, content []byte, perm os.FileMode) error {
+	if info, err := os.Stat(fullPath); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	dir := filepath.Dir(fullPath)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(fullPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, fullPath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// sync the directory so that the rename itself survives a crash
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// copyFile copies the file src to dst, which must not be a symlink
+func copyFile(src, dst string, mode os.FileMode) error {
+	if err := refuseSymlink(dst); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copyTree recursively copies the directory src to dst, symlinks are copied
+// as links unless the copy would point outside of root. Nothing is written
+// through a symlink already in dst.
+func copyTree(src, dst, root string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err := refuseSymlink(dst); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	infos, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		s := filepath.Join(src, info.Name())
+		d := filepath.Join(dst, info.Name())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(s)
+			if err != nil {
+				return err
+			}
+			resolved := target
+			if !filepath.IsAbs(target) {
+				resolved = filepath.Join(filepath.Dir(d), target)
+			}
+			if !isWithin(filepath.Clean(resolved), root) {
+				return &os.PathError{Op: "symlink", Path: d, Err: ErrOutsideRoot}
+			}
+			if err := os.Symlink(target, d); err != nil {
+				return err
+			}
+		case info.IsDir():
+			if err := copyTree(s, d, root); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if err := copyFile(s, d, info.Mode()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
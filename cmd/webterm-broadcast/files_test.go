@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nyxtom/broadcast/server"
+)
+
+// testClient records the replies written to it
+type testClient struct {
+	server.ProtocolClient
+
+	replies []interface{}
+	errs    []error
+}
+
+func (c *testClient) RemoteAddr() net.Addr { return nil }
+func (c *testClient) Flush() error         { return nil }
+
+func (c *testClient) WriteError(err error) error {
+	c.errs = append(c.errs, err)
+	return nil
+}
+
+func (c *testClient) WriteString(msg string) error {
+	c.replies = append(c.replies, msg)
+	return nil
+}
+
+func (c *testClient) WriteBytes(b []byte) error {
+	c.replies = append(c.replies, b)
+	return nil
+}
+
+func (c *testClient) WriteJson(v interface{}) error {
+	c.replies = append(c.replies, v)
+	return nil
+}
+
+// testBackend returns a term backend serving a temporary home directory
+// next to a directory outside of it
+func testBackend(t *testing.T) (*TermBackend, string, string) {
+	tmp, err := ioutil.TempDir("", "webterm-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmp) })
+	home, outside := filepath.Join(tmp, "home"), filepath.Join(tmp, "outside")
+	for _, dir := range []string{home, outside} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backend, err := RegisterTermBackend(&server.BroadcastServer{}, &TermConfig{
+		FileCommands: true,
+		HomeDir:      home,
+		HistoryLimit: 2,
+		Sandbox:      SandboxConfig{FollowSymlinks: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend.(*TermBackend), home, outside
+}
+
+func run(t *TermBackend, cmd string, args ...string) *testClient {
+	data := make([][]byte, len(args))
+	for i, arg := range args {
+		data[i] = []byte(arg)
+	}
+	client := &testClient{}
+	t.commands[strings.ToUpper(cmd)](data, client)
+	return client
+}
+
+func write(t *testing.T, file, content string) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyAndMoveStayInside(t *testing.T) {
+	backend, home, outside := testBackend(t)
+	write(t, filepath.Join(home, "notes.txt"), "notes")
+	write(t, filepath.Join(outside, "secret"), "secret")
+	write(t, filepath.Join(home, "docs", "sub", "a.txt"), "a")
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(home, "docs", "notes.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../notes.txt", filepath.Join(home, "docs", "sub", "link")); err != nil {
+		t.Fatal(err)
+	}
+	run(backend, "save", "kept.txt", "v1")
+	run(backend, "save", "--force", "kept.txt", "v2")
+
+	tests := [][]string{
+		{"cp", "notes.txt", "docs"},
+		{"mv", "notes.txt", "docs"},
+		{"cp", "notes.txt", ".webterm"},
+		{"cp", "notes.txt", ".webterm/history"},
+		{"mv", "notes.txt", ".webterm/history"},
+		{"cp", "-r", "docs/sub", "copy"},
+	}
+	for _, args := range tests {
+		if c := run(backend, args[0], args[1:]...); len(c.errs) == 0 {
+			t.Errorf("%s succeeded: %v", strings.Join(args, " "), c.replies)
+		}
+	}
+
+	if content, _ := ioutil.ReadFile(filepath.Join(outside, "secret")); string(content) != "secret" {
+		t.Errorf("file outside of the home directory was overwritten: %q", content)
+	}
+	if _, err := os.Lstat(filepath.Join(home, "copy", "link")); err == nil {
+		t.Error("copied a symlink pointing outside of the home directory")
+	}
+	if _, err := os.Stat(filepath.Join(home, "notes.txt")); err != nil {
+		t.Errorf("notes.txt was moved: %v", err)
+	}
+
+	if c := run(backend, "cp", "-r", "docs/sub", "docs/sub2"); len(c.errs) != 0 {
+		t.Errorf("cp -r within the same depth failed: %v", c.errs)
+	}
+}
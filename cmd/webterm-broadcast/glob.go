@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/nyxtom/broadcast/server"
+	"github.com/nyxtom/webterm/glob"
+)
+
+// ErrNoMatch is returned when a glob pattern does not match any file
+var ErrNoMatch = errors.New("no matches found")
+
+// maxGlobMatches caps the number of files a single pattern may expand to
+const maxGlobMatches = 10000
+
+// expandArgs expands the glob patterns in args against the sandbox, relative
+// to the working directory of the client. Arguments without any unescaped glob
+// characters are passed through as given, matches are escaped so that every
+// argument reaching resolve is in the same (escaped) form.
+func (t *TermBackend) expandArgs(client server.ProtocolClient, op string, args []string) ([]string, error) {
+	expanded := []string{}
+	for _, arg := range args {
+		if !glob.HasMeta(arg) {
+			expanded = append(expanded, arg)
+			continue
+		}
+
+		matches, err := t.glob(client, op, arg)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, &PathError{op, arg, ErrNoMatch}
+		}
+		for _, match := range matches {
+			expanded = append(expanded, glob.Escape(match))
+		}
+	}
+	return expanded, nil
+}
+
+// glob returns the files matching pattern, ** matches any number of directories
+func (t *TermBackend) glob(client server.ProtocolClient, op, pattern string) ([]string, error) {
+	base := t.sessions.Get(client).Cwd()
+	display := ""
+	if strings.HasPrefix(pattern, "/") {
+		base = "/"
+		display = "/"
+	}
+
+	segs := []string{}
+	for _, seg := range strings.Split(pattern, "/") {
+		if seg != "" && seg != "." {
+			segs = append(segs, seg)
+		}
+	}
+
+	g := &globber{t: t, client: client, op: op, seen: make(map[string]bool)}
+	if err := g.match(display, base, segs); err != nil {
+		return nil, err
+	}
+	sort.Strings(g.matches)
+	return g.matches, nil
+}
+
+type globber struct {
+	t       *TermBackend
+	client  server.ProtocolClient
+	op      string
+	matches []string
+	seen    map[string]bool
+}
+
+// match walks the remaining segments of the pattern starting at the sandbox
+// relative directory virt, display is the same location as the client typed it
+func (g *globber) match(display, virt string, segs []string) error {
+	if len(segs) == 0 {
+		if display != "" && !g.seen[display] && g.allowed(virt) {
+			if len(g.matches) >= maxGlobMatches {
+				return errors.New(g.op + ": too many matches")
+			}
+			g.seen[display] = true
+			g.matches = append(g.matches, display)
+		}
+		return nil
+	}
+
+	seg := segs[0]
+	if seg == ".." || !glob.HasMeta(seg) {
+		name := glob.Unescape(seg)
+		if name == ".." && virt == "/" {
+			return nil
+		}
+		next := path.Join(virt, name)
+		if len(segs) == 1 {
+			fullPath, err := g.t.sandbox.ResolveNoFollow(g.op, next)
+			if err != nil {
+				return nil
+			}
+			if _, err := os.Lstat(fullPath); err != nil {
+				return nil
+			}
+		}
+		return g.match(joinDisplay(display, name), next, segs[1:])
+	}
+
+	fullPath, err := g.t.sandbox.Resolve(g.op, virt)
+	if err != nil {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(fullPath)
+	if err != nil {
+		return nil
+	}
+
+	if seg == "**" {
+		// zero directories, then every directory below this one
+		if err := g.match(display, virt, segs[1:]); err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if strings.HasPrefix(info.Name(), ".") {
+				continue
+			}
+			if !info.IsDir() {
+				// a trailing ** matches files as well as directories
+				if len(segs) == 1 {
+					if err := g.match(joinDisplay(display, info.Name()), path.Join(virt, info.Name()), nil); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err := g.match(joinDisplay(display, info.Name()), path.Join(virt, info.Name()), segs); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(seg, ".") {
+			continue
+		}
+		ok, err := path.Match(seg, name)
+		if err != nil {
+			return &PathError{g.op, seg, err}
+		}
+		if !ok {
+			continue
+		}
+		if len(segs) > 1 && !info.IsDir() && info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if err := g.match(joinDisplay(display, name), path.Join(virt, name), segs[1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allowed reports whether the client may use the match, those the policy
+// denies or in the state directory are left out as if they did not exist
+func (g *globber) allowed(virt string) bool {
+	fullPath, err := g.t.sandbox.ResolveNoFollow(g.op, virt)
+	if err != nil || g.t.isState(fullPath) {
+		return false
+	}
+	return g.t.authorizePath(g.client, g.op, g.t.sandbox.Rel(fullPath)) == nil
+}
+
+func joinDisplay(display, name string) string {
+	if display == "" {
+		return name
+	}
+	if strings.HasSuffix(display, "/") {
+		return display + name
+	}
+	return display + "/" + name
+}
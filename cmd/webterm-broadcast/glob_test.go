@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/nyxtom/webterm/policy"
+)
+
+func TestGlobSkipsDeniedPaths(t *testing.T) {
+	backend, home, _ := testBackend(t)
+	for _, file := range []string{"public/a.txt", "public/b.md", "private/c.txt", "notes.txt"} {
+		write(t, filepath.Join(home, filepath.FromSlash(file)), "x")
+	}
+	p, err := policy.New(&policy.Config{
+		ConnectionRole: "reader",
+		Roles:          map[string]*policy.Role{"reader": {Commands: []string{"cat", "ls"}, Paths: []string{"/public"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.policy = p
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"*", []string{"public"}},
+		{"*/*.txt", []string{"public/a.txt"}},
+		{"**/*.txt", []string{"public/a.txt"}},
+		{"/p*/*", []string{"/public/a.txt", "/public/b.md"}},
+		{"private/*", []string{}},
+	}
+	for _, test := range tests {
+		got, err := backend.glob(&testClient{}, "cat", test.pattern)
+		if err != nil {
+			t.Errorf("glob(%q) failed: %v", test.pattern, err)
+			continue
+		}
+		if got == nil {
+			got = []string{}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("glob(%q) = %q, want %q", test.pattern, got, test.want)
+		}
+	}
+
+	if c := run(backend, "cat", "*/*.txt"); len(c.errs) != 0 {
+		t.Errorf("cat of the allowed matches failed: %v", c.errs)
+	}
+}
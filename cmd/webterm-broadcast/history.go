@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nyxtom/broadcast/server"
+)
+
+// stateDir is the hidden directory under the home directory webterm keeps its
+// own files in, clients can not reach it
+const stateDir = ".webterm"
+
+// historyDir is the directory under the home directory where revisions are kept
+const historyDir = stateDir + "/history"
+
+// versionExt names the file next to each revision holding the version token
+// the file had when the revision was recorded
+const versionExt = ".version"
+
+// ErrStateDir is returned for paths inside of the state directory
+var ErrStateDir = errors.New("permission denied, the directory is kept by webterm")
+
+// defaultHistoryLimit is the number of previous revisions kept for each file
+const defaultHistoryLimit = 10
+
+// Revision describes a previous version of a file kept in the history store
+type Revision struct {
+	Rev     int    `json:"rev"`
+	Size    int64  `json:"size"`
+	Saved   string `json:"saved"`
+	Version string `json:"version"`
+}
+
+// History keeps the previous revisions of files saved through the term backend
+type History struct {
+	sandbox *Sandbox
+	limit   int
+}
+
+// NewHistory returns a history store under the sandbox root keeping limit revisions per file
+func NewHistory(sandbox *Sandbox, limit int) *History {
+	return &History{sandbox, limit}
+}
+
+// dir returns the directory holding the revisions of the file at fullPath,
+// files inside of the history store itself have no history. The directory is
+// named by the hash of the path so that the revisions of a file never share a
+// directory with those of the files below it once it is replaced by one.
+func (h *History) dir(fullPath string) (string, bool) {
+	root := filepath.Join(h.sandbox.Root(), filepath.FromSlash(historyDir))
+	if isWithin(fullPath, root) {
+		return "", false
+	}
+	rel, err := filepath.Rel(h.sandbox.Root(), fullPath)
+	if err != nil || rel == "." {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(filepath.ToSlash(rel)))
+	return filepath.Join(root, hex.EncodeToString(sum[:])), true
+}
+
+// Revisions lists the revisions of the file at fullPath, oldest first
+func (h *History) Revisions(fullPath string) ([]Revision, error) {
+	dir, ok := h.dir(fullPath)
+	if !ok {
+		return []Revision{}, nil
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []Revision{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	revs := []Revision{}
+	for _, info := range infos {
+		rev, err := strconv.Atoi(info.Name())
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		version, err := revisionVersion(filepath.Join(dir, info.Name()), info)
+		if err != nil {
+			return nil, err
+		}
+		revs = append(revs, Revision{rev, info.Size(), info.ModTime().Format(time.RFC3339), version})
+	}
+	sort.Slice(revs, func(i, j int) bool { return revs[i].Rev < revs[j].Rev })
+	return revs, nil
+}
+
+// revisionVersion reads the version stored next to the revision at file,
+// revisions recorded before versions were stored are read in full instead
+func revisionVersion(file string, info os.FileInfo) (string, error) {
+	version, err := ioutil.ReadFile(file + versionExt)
+	if err == nil {
+		return string(version), nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return fileVersion(info, content), nil
+}
+
+// Load returns the contents of the given revision of the file at fullPath
+func (h *History) Load(fullPath string, rev int) ([]byte, error) {
+	dir, ok := h.dir(fullPath)
+	if !ok {
+		return nil, errors.New("no such revision")
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, strconv.Itoa(rev)))
+	if os.IsNotExist(err) {
+		return nil, errors.New("no such revision")
+	}
+	return content, err
+}
+
+// Record stores the current contents of the file at fullPath as a new
+// revision, dropping the oldest revisions beyond the limit
+func (h *History) Record(fullPath string) error {
+	dir, ok := h.dir(fullPath)
+	if !ok || h.limit <= 0 {
+		return nil
+	}
+	info, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(fullPath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	revs, err := h.Revisions(fullPath)
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(revs) > 0 {
+		next = revs[len(revs)-1].Rev + 1
+	}
+	file := filepath.Join(dir, strconv.Itoa(next))
+	if err := writeFileAtomic(file+versionExt, []byte(fileVersion(info, content)), 0600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(file, content, 0600); err != nil {
+		return err
+	}
+
+	for len(revs) >= h.limit {
+		file := filepath.Join(dir, strconv.Itoa(revs[0].Rev))
+		os.Remove(file)
+		os.Remove(file + versionExt)
+		revs = revs[1:]
+	}
+	return nil
+}
+
+// isState reports whether the resolved path is the state directory or inside of it
+func (t *TermBackend) isState(fullPath string) bool {
+	return isWithin(fullPath, filepath.Join(t.sandbox.Root(), stateDir))
+}
+
+// storeFile atomically replaces the file at fullPath with content, keeping
+// the previous contents in the history store
+func (t *TermBackend) storeFile(fullPath string, content []byte) error {
+	if err := t.history.Record(fullPath); err != nil {
+		return err
+	}
+	return writeFileAtomic(fullPath, content, 0644)
+}
+
+func (t *TermBackend) ShowHistory(data interface{}, client server.ProtocolClient) error {
+	d, _ := data.([][]byte)
+	if len(d) == 0 {
+		t.writeError(client, errors.New("history takes at least 1 parameter (history filename)"))
+		return nil
+	}
+	fileName := string(d[0])
+	fullPath, err := t.resolve(client, "history", fileName)
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+	revs, err := t.history.Revisions(fullPath)
+	if err != nil {
+		t.writeError(client, newPathError("history", fileName, err))
+		return nil
+	}
+
+	client.WriteJson(map[string]interface{}{"filename": fileName, "revisions": revs})
+	client.Flush()
+	return nil
+}
+
+func (t *TermBackend) ShowRevision(data interface{}, client server.ProtocolClient) error {
+	d, _ := data.([][]byte)
+	if len(d) == 0 {
+		t.writeError(client, errors.New("show takes at least 1 parameter (show filename@rev)"))
+		return nil
+	}
+	arg := string(d[0])
+	i := strings.LastIndex(arg, "@")
+	if i < 0 {
+		t.writeError(client, errors.New("show takes a revision (show filename@rev)"))
+		return nil
+	}
+	fileName := arg[:i]
+	content, err := t.loadRevision(client, "show", fileName, arg[i+1:])
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+
+	client.WriteBytes(content)
+	client.Flush()
+	return nil
+}
+
+func (t *TermBackend) RevertFile(data interface{}, client server.ProtocolClient) error {
+	d, _ := data.([][]byte)
+	if len(d) < 2 {
+		t.writeError(client, errors.New("revert takes at least 2 parameters (revert filename rev)"))
+		return nil
+	}
+	fileName := string(d[0])
+	content, err := t.loadRevision(client, "revert", fileName, string(d[1]))
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+	fullPath, err := t.resolve(client, "revert", fileName)
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+
+	t.saveLock.Lock()
+	defer t.saveLock.Unlock()
+	if err := t.storeFile(fullPath, content); err != nil {
+		t.writeError(client, newPathError("revert", fileName, err))
+		return nil
+	}
+
+	client.WriteString("reverted " + fileName + " to revision " + string(d[1]))
+	client.Flush()
+	return nil
+}
+
+func (t *TermBackend) loadRevision(client server.ProtocolClient, op, fileName, rev string) ([]byte, error) {
+	n, err := strconv.Atoi(rev)
+	if err != nil {
+		return nil, &PathError{op, fileName + "@" + rev, errors.New("invalid revision")}
+	}
+	fullPath, err := t.resolve(client, op, fileName)
+	if err != nil {
+		return nil, err
+	}
+	content, err := t.history.Load(fullPath, n)
+	if err != nil {
+		return nil, newPathError(op, fileName+"@"+rev, err)
+	}
+	return content, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHistoryOfAFileReplacedByADirectory(t *testing.T) {
+	sandbox, root := testSandbox(t)
+	history := NewHistory(sandbox, 5)
+	save := func(name, content string) {
+		fullPath := filepath.Join(root, filepath.FromSlash(name))
+		if err := history.Record(fullPath); err != nil {
+			t.Fatalf("Record(%s) failed: %v", name, err)
+		}
+		if err := ioutil.WriteFile(fullPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	x := filepath.Join(root, "x")
+	save("x", "first")
+	save("x", "second")
+	if err := os.Remove(x); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(x, 0755); err != nil {
+		t.Fatal(err)
+	}
+	save("x/1", "one")
+	save("x/1", "two")
+
+	if revs, err := history.Revisions(x); err != nil || len(revs) != 1 {
+		t.Errorf("Revisions(x) = %v, %v, want 1 revision", revs, err)
+	}
+	if content, err := history.Load(x, 1); err != nil || string(content) != "first" {
+		t.Errorf("Load(x, 1) = %q, %v", content, err)
+	}
+	one := filepath.Join(x, "1")
+	if revs, err := history.Revisions(one); err != nil || len(revs) != 1 {
+		t.Errorf("Revisions(x/1) = %v, %v, want 1 revision", revs, err)
+	}
+	if content, err := history.Load(one, 1); err != nil || string(content) != "one" {
+		t.Errorf("Load(x/1, 1) = %q, %v", content, err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/nyxtom/broadcast/server"
+)
+
+const identifyUsage = "identify secret [--dirs key] [user [role...]]"
+
+// Identify sets the user (and their roles) that the commands of this
+// connection are run for, it is sent by the web server for every browser.
+// Only the web server knows the identify secret of the policy, connections
+// that present it are given the roles of the user (or the default role
+// without one) instead of the connection role. The connection starts from
+// the home directory unless --dirs continues the directories of the
+// browser kept under key.
+func (t *TermBackend) Identify(data interface{}, client server.ProtocolClient) error {
+	d, _ := data.([][]byte)
+	if len(d) == 0 {
+		t.writeError(client, errors.New("identify takes at least 1 parameter ("+identifyUsage+")"))
+		return nil
+	}
+	if !t.policy.CheckSecret(string(d[0])) {
+		t.writeError(client, errors.New("identify: invalid secret"))
+		return nil
+	}
+	d = d[1:]
+	key := ""
+	if len(d) > 0 && string(d[0]) == "--dirs" {
+		if len(d) < 2 || len(d[1]) == 0 {
+			t.writeError(client, errors.New("identify: --dirs takes a key ("+identifyUsage+")"))
+			return nil
+		}
+		key = string(d[1])
+		d = d[2:]
+	}
+	user, roles := "", []string{}
+	if len(d) > 0 {
+		user = string(d[0])
+		for _, r := range d[1:] {
+			roles = append(roles, string(r))
+		}
+	}
+	t.sessions.Rebind(client, key).Identify(user, roles)
+	client.WriteString("OK")
+	client.Flush()
+	return nil
+}
+
+const sessionUsage = "session [key]"
+
+// Session starts the directories (working directory, previous directory and
+// directory stack) of this connection from the home directory, or continues
+// those kept under key. The web server sends it before every command instead
+// of identify when the policy has no identify secret, a pooled connection
+// then never keeps the directories of the browser it last ran commands for.
+// The sessions of identified users can only be continued with identify.
+func (t *TermBackend) Session(data interface{}, client server.ProtocolClient) error {
+	d, _ := data.([][]byte)
+	key := ""
+	if len(d) > 0 {
+		key = string(d[0])
+	}
+	if _, ok := t.sessions.RebindAnonymous(client, key); !ok {
+		t.writeError(client, errors.New("session: the key belongs to an identified user"))
+		return nil
+	}
+	client.WriteString("OK")
+	client.Flush()
+	return nil
+}
+
+// roles returns the roles the commands of the client are checked against, the
+// roles of the identified user for the web server's connections and the
+// connection role for any other, nil gives the default role
+func (t *TermBackend) roles(client server.ProtocolClient) []string {
+	if _, roles, ok := t.sessions.Get(client).Identity(); ok {
+		return roles
+	}
+	return t.policy.ConnectionRoles()
+}
+
+// authorize checks that the client may run cmd
+func (t *TermBackend) authorize(client server.ProtocolClient, cmd string) error {
+	if t.policy == nil {
+		return nil
+	}
+	return t.policy.AllowCommand(t.roles(client), cmd)
+}
+
+// authorizePath checks that the client may use the path (relative to the home directory)
+func (t *TermBackend) authorizePath(client server.ProtocolClient, op, name string) error {
+	if t.policy == nil {
+		return nil
+	}
+	return t.policy.AllowPath(t.roles(client), op, name)
+}
+
+// registerCommand registers the command with the broadcast server and makes it
+// available to pipelines run through sh, the policy is checked before every run
+// and runs sent by clients (rather than pipeline stages) are audited and measured
+func (t *TermBackend) registerCommand(cmd server.Command, handler func(interface{}, server.ProtocolClient) error) {
+	checked := func(data interface{}, client server.ProtocolClient) error {
+		if err := t.authorize(client, cmd.Name); err != nil {
+			t.writeError(client, err)
+			return nil
+		}
+		return handler(data, client)
+	}
+	t.commands[strings.ToUpper(cmd.Name)] = checked
+	t.help[strings.ToUpper(cmd.Name)] = cmd
+	t.app.RegisterCommand(cmd, t.measured(cmd.Name, t.audited(cmd.Name, checked)))
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nyxtom/broadcast/server"
+	"github.com/nyxtom/webterm/glob"
+)
+
+const lsUsage = "ls [-l] [-a] [-R] [-h] [--sort=name|size|mtime] [path...]"
+
+// maxListEntries caps the number of entries returned by a single (recursive) listing
+const maxListEntries = 10000
+
+// FileEntry describes a single file as returned to clients by ls
+type FileEntry struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Size   int64  `json:"size"`
+	Mode   string `json:"mode"`
+	Mtime  string `json:"mtime"`
+	Target string `json:"target,omitempty"`
+
+	modTime time.Time
+}
+
+// DirListing groups the entries found for one of the paths given to ls
+type DirListing struct {
+	Path    string      `json:"path"`
+	Entries []FileEntry `json:"entries"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// Listing is the reply of ls, the long and human flags tell clients how to render it
+type Listing struct {
+	Long      bool         `json:"long"`
+	Human     bool         `json:"human"`
+	Truncated bool         `json:"truncated,omitempty"`
+	Listings  []DirListing `json:"listings"`
+}
+
+// PipeText lists the entry names one per line when ls is used inside of a pipeline
+func (l *Listing) PipeText() []byte {
+	var out bytes.Buffer
+	for i, listing := range l.Listings {
+		if listing.Error != "" {
+			continue
+		}
+		if len(l.Listings) > 1 && listing.Path != "" {
+			if i > 0 {
+				out.WriteString("\n")
+			}
+			out.WriteString(listing.Path + ":\n")
+		}
+		for _, entry := range listing.Entries {
+			out.WriteString(entry.Name + "\n")
+		}
+	}
+	return out.Bytes()
+}
+
+type lsOptions struct {
+	long      bool
+	all       bool
+	recursive bool
+	human     bool
+	sortBy    string
+	paths     []string
+}
+
+func parseLsOptions(d [][]byte) (*lsOptions, error) {
+	opts := &lsOptions{sortBy: "name"}
+	flags := true
+	for _, arg := range d {
+		a := string(arg)
+		if !flags || len(a) < 2 || a[0] != '-' {
+			opts.paths = append(opts.paths, a)
+			continue
+		}
+		if a == "--" {
+			flags = false
+		} else if strings.HasPrefix(a, "--sort=") {
+			opts.sortBy = strings.TrimPrefix(a, "--sort=")
+			if opts.sortBy != "name" && opts.sortBy != "size" && opts.sortBy != "mtime" {
+				return nil, errors.New("ls: invalid sort '" + opts.sortBy + "' (name, size or mtime)")
+			}
+		} else if strings.HasPrefix(a, "--") {
+			return nil, errors.New("ls: unrecognized option '" + a + "'")
+		} else {
+			for _, c := range a[1:] {
+				switch c {
+				case 'l':
+					opts.long = true
+				case 'a':
+					opts.all = true
+				case 'R':
+					opts.recursive = true
+				case 'h':
+					opts.human = true
+				default:
+					return nil, errors.New("ls: invalid option -- '" + string(c) + "'")
+				}
+			}
+		}
+	}
+
+	if len(opts.paths) == 0 {
+		opts.paths = []string{"."}
+	}
+	return opts, nil
+}
+
+func (t *TermBackend) ListFiles(data interface{}, client server.ProtocolClient) error {
+	d, _ := data.([][]byte)
+	opts, err := parseLsOptions(d)
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+
+	opts.paths, err = t.expandArgs(client, "ls", opts.paths)
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+
+	listing := &Listing{Long: opts.long, Human: opts.human}
+	files := DirListing{Entries: []FileEntry{}}
+	dirs := []DirListing{}
+	count := 0
+	for _, name := range opts.paths {
+		fullPath, err := t.resolve(client, "ls", name)
+		if err != nil {
+			dirs = append(dirs, DirListing{Path: name, Entries: []FileEntry{}, Error: err.Error()})
+			continue
+		}
+
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			dirs = append(dirs, DirListing{Path: name, Entries: []FileEntry{}, Error: newPathError("ls", name, err).Error()})
+			continue
+		}
+
+		if !info.IsDir() {
+			// described by lstat like the entries of a directory, so a symlink shows as one
+			if linkPath, err := t.resolveNoFollow(client, "ls", name); err == nil {
+				if linfo, err := os.Lstat(linkPath); err == nil {
+					fullPath, info = linkPath, linfo
+				}
+			}
+			entry := t.fileEntry(fullPath, info)
+			entry.Name = glob.Unescape(name)
+			files.Entries = append(files.Entries, entry)
+			count++
+			continue
+		}
+
+		dirs = t.listDir(dirs, glob.Unescape(name), fullPath, opts, &count)
+		if count >= maxListEntries {
+			listing.Truncated = true
+			break
+		}
+	}
+
+	if len(files.Entries) > 0 {
+		sortEntries(files.Entries, opts.sortBy)
+		listing.Listings = append(listing.Listings, files)
+	}
+	listing.Listings = append(listing.Listings, dirs...)
+
+	client.WriteJson(listing)
+	client.Flush()
+	return nil
+}
+
+// listDir appends the listing of the given directory (and its subdirectories
+// when listing recursively) onto dirs
+func (t *TermBackend) listDir(dirs []DirListing, name, fullPath string, opts *lsOptions, count *int) []DirListing {
+	infos, err := ioutil.ReadDir(fullPath)
+	if err != nil {
+		return append(dirs, DirListing{Path: name, Entries: []FileEntry{}, Error: newPathError("ls", name, err).Error()})
+	}
+
+	group := DirListing{Path: name, Entries: []FileEntry{}}
+	subdirs := []string{}
+	for _, info := range infos {
+		if !opts.all && strings.HasPrefix(info.Name(), ".") || t.isState(filepath.Join(fullPath, info.Name())) {
+			continue
+		}
+		if *count >= maxListEntries {
+			break
+		}
+		group.Entries = append(group.Entries, t.fileEntry(filepath.Join(fullPath, info.Name()), info))
+		*count++
+		if info.IsDir() {
+			subdirs = append(subdirs, info.Name())
+		}
+	}
+	sortEntries(group.Entries, opts.sortBy)
+	dirs = append(dirs, group)
+
+	if opts.recursive {
+		for _, sub := range subdirs {
+			if *count >= maxListEntries {
+				break
+			}
+			dirs = t.listDir(dirs, path.Join(name, sub), filepath.Join(fullPath, sub), opts, count)
+		}
+	}
+	return dirs
+}
+
+// fileEntry describes the file at fullPath, info must come from an lstat of the file
+func (t *TermBackend) fileEntry(fullPath string, info os.FileInfo) FileEntry {
+	entry := FileEntry{
+		Name:  info.Name(),
+		Type:  fileType(info.Mode()),
+		Size:  info.Size(),
+		Mode:  info.Mode().String(),
+		Mtime: info.ModTime().Format(time.RFC3339),
+
+		modTime: info.ModTime(),
+	}
+	if strings.HasPrefix(entry.Mode, "L") {
+		entry.Mode = "l" + entry.Mode[1:]
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		if target, err := os.Readlink(fullPath); err == nil {
+			entry.Target = t.linkTarget(target)
+		}
+	}
+	return entry
+}
+
+// linkTarget hides any absolute server locations a symlink may point at
+func (t *TermBackend) linkTarget(target string) string {
+	if !filepath.IsAbs(target) {
+		return filepath.ToSlash(target)
+	}
+	root := t.sandbox.Root()
+	if target == root || strings.HasPrefix(target, root+string(filepath.Separator)) {
+		return t.sandbox.Rel(target)
+	}
+	return "?"
+}
+
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode.IsDir():
+		return "dir"
+	case mode.IsRegular():
+		return "file"
+	}
+	return "other"
+}
+
+func sortEntries(entries []FileEntry, sortBy string) {
+	switch sortBy {
+	case "size":
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Size > entries[j].Size })
+	case "mtime":
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].modTime.After(entries[j].modTime) })
+	default:
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	}
+}
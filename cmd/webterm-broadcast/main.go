@@ -1,10 +1,10 @@
 package main
 
 import (
-	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
@@ -13,16 +13,30 @@ import (
 	"time"
 
 	"github.com/BurntSushi/toml"
-	"github.com/nyxtom/broadcast/backends/bdefault"
 	"github.com/nyxtom/broadcast/protocols/line"
 	"github.com/nyxtom/broadcast/protocols/redis"
 	"github.com/nyxtom/broadcast/server"
+	"github.com/nyxtom/webterm/audit"
+	"github.com/nyxtom/webterm/metrics"
+	"github.com/nyxtom/webterm/policy"
 )
 
-type Configuration struct {
-	port      int    // port of the server
-	host      string // host of the server
-	bprotocol string // broadcast protocol configuration
+// loadPolicy reads the [policy] table of a toml file, other tables are ignored
+func loadPolicy(policyFile string) (*policy.Policy, error) {
+	if policyFile == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(policyFile)
+	if err != nil {
+		return nil, err
+	}
+	file := &struct {
+		Policy policy.Config `toml:"policy"`
+	}{}
+	if _, err := toml.Decode(string(data), file); err != nil {
+		return nil, err
+	}
+	return policy.New(&file.Policy)
 }
 
 var LogoHeader = `
@@ -38,47 +52,50 @@ func main() {
 	// Leverage all cores available
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	// Parse out flag parameters
-	var host = flag.String("h", "127.0.0.1", "webterm host to bind to")
-	var port = flag.Int("p", 7337, "webterm port to bind to")
-	var bprotocol = flag.String("bprotocol", "redis", "Broadcast protocol configuration")
+	// Parse out flag parameters, every key of the config file has one
 	var configFile = flag.String("config", "", "webterm configuration file (/etc/webterm.conf)")
-	var cpuProfile = flag.String("cpuprofile", "", "write cpu profile to file")
-	var homedir = flag.String("homedir", "", "home directory to serve static files")
+	var printConfig = flag.Bool("print-config", false, "print the effective configuration and exit")
+	attachConfigFlags(DefaultConfig())
 
 	flag.Parse()
 
-	cfg := &Configuration{*port, *host, *bprotocol}
-	if len(*configFile) == 0 {
-		fmt.Printf("[%d] %s # WARNING: no config file specified, using the default config\n", os.Getpid(), time.Now().Format(time.RFC822))
-	} else {
-		data, err := ioutil.ReadFile(*configFile)
-		if err != nil {
+	cfg, err := LoadConfig(*configFile)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if *printConfig {
+		if err := cfg.Print(); err != nil {
 			fmt.Println(err)
-			return
 		}
-		_, err = toml.Decode(string(data), cfg)
+		return
+	}
+
+	// server events are written to the log file (stdout when there is none)
+	logOut := os.Stdout
+	if cfg.LogFile != "" {
+		logOut, err = os.OpenFile(cfg.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
 	}
+	if len(*configFile) == 0 {
+		fmt.Fprintf(logOut, "[%d] %s # WARNING: no config file specified, using the default config\n", os.Getpid(), time.Now().Format(time.RFC822))
+	}
 
 	// locate the protocol specified (if there is one)
 	var serverProtocol server.BroadcastServerProtocol
-	if cfg.bprotocol == "" {
+	if cfg.Protocol == "" {
 		serverProtocol = server.NewDefaultBroadcastServerProtocol()
-	} else if cfg.bprotocol == "redis" {
+	} else if cfg.Protocol == "redis" {
 		serverProtocol = redisProtocol.NewRedisProtocol()
-	} else if cfg.bprotocol == "line" {
+	} else if cfg.Protocol == "line" {
 		serverProtocol = lineProtocol.NewLineProtocol()
-	} else {
-		fmt.Println(errors.New("Invalid protocol " + cfg.bprotocol + " specified"))
-		return
 	}
 
-	if *cpuProfile != "" {
-		f, err := os.Create(*cpuProfile)
+	if cfg.CPUProfile != "" {
+		f, err := os.Create(cfg.CPUProfile)
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -86,8 +103,14 @@ func main() {
 		pprof.StartCPUProfile(f)
 	}
 
+	registry := metrics.NewRegistry()
+	metrics.RegisterRuntime(registry)
+	serverProtocol, clients := CountClients(serverProtocol, registry)
+	sessions := NewSessionStore()
+	serverProtocol = sessions.Track(serverProtocol)
+
 	// create a new broadcast server
-	app, err := server.ListenProtocol(cfg.port, cfg.host, serverProtocol)
+	app, err := server.ListenProtocol(cfg.Port, cfg.Host, serverProtocol)
 	app.Header = ""
 	app.Name = "WebTerm"
 	app.Version = "0.1.0"
@@ -97,16 +120,38 @@ func main() {
 		return
 	}
 
-	// setup default backend
-	backend, err := bdefault.RegisterBackend(app)
+	// load the command policy shared with the web server
+	commandPolicy, err := loadPolicy(cfg.PolicyFile)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	app.LoadBackend(backend)
 
-	// setup bgraph backend
-	backend, err = RegisterTermBackend(app, *homedir)
+	var auditLog *audit.Logger
+	if cfg.AuditFile != "" {
+		auditLog, err = audit.Open(cfg.AuditFile, cfg.AuditMaxSize, cfg.AuditMaxBackups)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	// setup the term backend, the default commands are its own so that the
+	// policy, audit log and metrics apply to them too
+	backend, err := RegisterTermBackend(app, &TermConfig{
+		DefaultCommands: cfg.Backends.Default,
+		FileCommands:    cfg.Backends.Term,
+		HomeDir:         cfg.HomeDir,
+		ResumeFile:      cfg.ResumeFile,
+		ResumeCmd:       cfg.ResumeCmd,
+		HistoryLimit:    cfg.HistoryLimit,
+		Sandbox:         cfg.Sandbox,
+		Policy:          commandPolicy,
+		Audit:           auditLog,
+		Metrics:         registry,
+		Clients:         clients,
+		Sessions:        sessions,
+	})
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -128,10 +173,21 @@ func main() {
 				msg += fmt.Sprintf(" %v", event.Err)
 			}
 
-			fmt.Println(msg)
+			fmt.Fprintln(logOut, msg)
 		}
 	}()
 
+	// serve the metrics over http for scrapers
+	if cfg.StatsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry.Handler())
+		go func() {
+			app.Events <- server.BroadcastEvent{Level: "info", Message: "serving metrics on http://" + cfg.StatsAddr + "/metrics"}
+			err := http.ListenAndServe(cfg.StatsAddr, mux)
+			app.Events <- server.BroadcastEvent{Level: "error", Message: "unable to serve metrics on " + cfg.StatsAddr, Err: err}
+		}()
+	}
+
 	go func() {
 		<-app.Quit
 		pprof.StopCPUProfile()
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nyxtom/broadcast/server"
+	"github.com/nyxtom/webterm/metrics"
+)
+
+const metricsUsage = "metrics [prometheus]"
+
+// CommandMetrics counts the runs of the commands registered by the term
+// backend along with their errors, latency and the bytes they receive and send
+type CommandMetrics struct {
+	registry *metrics.Registry
+	names    []string
+	start    time.Time
+	clients  *metrics.Gauge
+
+	calls    *metrics.Counter
+	errors   *metrics.Counter
+	bytesIn  *metrics.Counter
+	bytesOut *metrics.Counter
+	duration *metrics.Histogram
+}
+
+// NewCommandMetrics registers the command metrics in the registry, clients
+// counts the connected clients (see CountClients), nil to add one that stays
+// at zero
+func NewCommandMetrics(r *metrics.Registry, clients *metrics.Gauge) *CommandMetrics {
+	if clients == nil {
+		clients = newClientsGauge(r)
+	}
+	m := &CommandMetrics{registry: r, start: time.Now(), clients: clients}
+	m.calls = r.NewCounter("webterm_broadcast_commands_total", "Number of commands run by command.", "command")
+	m.errors = r.NewCounter("webterm_broadcast_command_errors_total", "Number of commands that replied with an error by command.", "command")
+	m.bytesIn = r.NewCounter("webterm_broadcast_command_received_bytes_total", "Size of the arguments of commands by command.", "command")
+	m.bytesOut = r.NewCounter("webterm_broadcast_command_sent_bytes_total", "Size of the replies of commands by command.", "command")
+	m.duration = r.NewHistogram("webterm_broadcast_command_duration_seconds", "Time taken to run commands by command.", metrics.DefaultBuckets, "command")
+	return m
+}
+
+func newClientsGauge(r *metrics.Registry) *metrics.Gauge {
+	g := r.NewGauge("webterm_broadcast_clients", "Number of connected clients.")
+	g.Set(0)
+	return g
+}
+
+// countedProtocol stands in for the protocol of the server, counting the
+// clients it runs from the moment they connect until they disconnect
+type countedProtocol struct {
+	server.BroadcastServerProtocol
+
+	clients *metrics.Gauge
+}
+
+func (p *countedProtocol) RunClient(client server.ProtocolClient) {
+	p.clients.Add(1)
+	defer p.clients.Add(-1)
+	p.BroadcastServerProtocol.RunClient(client)
+}
+
+// CountClients wraps the protocol so that the connected clients are counted in
+// the registry, the returned gauge is passed on to the term backend
+func CountClients(p server.BroadcastServerProtocol, r *metrics.Registry) (server.BroadcastServerProtocol, *metrics.Gauge) {
+	clients := newClientsGauge(r)
+	return &countedProtocol{BroadcastServerProtocol: p, clients: clients}, clients
+}
+
+// Clients returns the number of connected clients
+func (m *CommandMetrics) Clients() int {
+	return int(m.clients.Value())
+}
+
+// add starts the series of a command at zero so that commands never run are listed too
+func (m *CommandMetrics) add(name string) {
+	m.names = append(m.names, name)
+	for _, c := range []*metrics.Counter{m.calls, m.errors, m.bytesIn, m.bytesOut} {
+		c.Add(0, name)
+	}
+}
+
+// CommandStats is the reply of metrics
+type CommandStats struct {
+	Clients       int            `json:"clients"`
+	UptimeSeconds float64        `json:"uptime_seconds"`
+	Commands      []*CommandStat `json:"commands"`
+}
+
+// CommandStat sums up the runs of a command, p99 is nil when it is above the
+// largest latency bucket
+type CommandStat struct {
+	Name     string   `json:"cmd"`
+	Calls    uint64   `json:"calls"`
+	Errors   uint64   `json:"errors"`
+	AvgMs    float64  `json:"avg_ms"`
+	P99Ms    *float64 `json:"p99_ms"`
+	BytesIn  uint64   `json:"bytes_in"`
+	BytesOut uint64   `json:"bytes_out"`
+}
+
+// PipeText renders the commands as a table inside of a pipeline
+func (s *CommandStats) PipeText() []byte {
+	var out bytes.Buffer
+	w := tabwriter.NewWriter(&out, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "cmd\tcalls\terrors\tavg ms\tp99 ms\tbytes in\tbytes out\t\n")
+	for _, c := range s.Commands {
+		p99 := "-"
+		if c.P99Ms != nil {
+			p99 = fmt.Sprintf("%.1f", *c.P99Ms)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%s\t%d\t%d\t\n", c.Name, c.Calls, c.Errors, c.AvgMs, p99, c.BytesIn, c.BytesOut)
+	}
+	w.Flush()
+	fmt.Fprintf(&out, "%d clients, up %s\n", s.Clients, time.Duration(s.UptimeSeconds*float64(time.Second)).Round(time.Second))
+	return out.Bytes()
+}
+
+// Stats sums up every command, the slowest on average first
+func (m *CommandMetrics) Stats(clients int) *CommandStats {
+	stats := &CommandStats{Clients: clients, UptimeSeconds: time.Since(m.start).Seconds()}
+	for _, name := range m.names {
+		count, sum := m.duration.Stats(name)
+		c := &CommandStat{
+			Name:     name,
+			Calls:    uint64(m.calls.Value(name)),
+			Errors:   uint64(m.errors.Value(name)),
+			BytesIn:  uint64(m.bytesIn.Value(name)),
+			BytesOut: uint64(m.bytesOut.Value(name)),
+		}
+		if count > 0 {
+			c.AvgMs = sum / float64(count) * 1000
+			if p99 := m.duration.Quantile(0.99, name); !math.IsInf(p99, 1) {
+				ms := p99 * 1000
+				c.P99Ms = &ms
+			}
+		}
+		stats.Commands = append(stats.Commands, c)
+	}
+	sort.SliceStable(stats.Commands, func(i, j int) bool {
+		return stats.Commands[i].AvgMs > stats.Commands[j].AvgMs
+	})
+	return stats
+}
+
+// metricsClient stands in for the protocol client while a command runs,
+// counting the size of its replies (before the protocol encodes them) and
+// remembering the error it replied with
+type metricsClient struct {
+	server.ProtocolClient
+
+	out int
+	err error
+}
+
+func (m *metricsClient) WriteError(err error) error {
+	m.err = err
+	m.out += len(err.Error())
+	return m.ProtocolClient.WriteError(err)
+}
+
+func (m *metricsClient) WriteString(msg string) error {
+	m.out += len(msg)
+	return m.ProtocolClient.WriteString(msg)
+}
+
+func (m *metricsClient) WriteBytes(b []byte) error {
+	m.out += len(b)
+	return m.ProtocolClient.WriteBytes(b)
+}
+
+func (m *metricsClient) WriteInt64(num int64) error {
+	m.out += 8
+	return m.ProtocolClient.WriteInt64(num)
+}
+
+func (m *metricsClient) WriteFloat64(num float64) error {
+	m.out += 8
+	return m.ProtocolClient.WriteFloat64(num)
+}
+
+func (m *metricsClient) WriteBool(b bool) error {
+	m.out++
+	return m.ProtocolClient.WriteBool(b)
+}
+
+func (m *metricsClient) WriteArray(arr []interface{}) error {
+	m.out += jsonSize(arr)
+	return m.ProtocolClient.WriteArray(arr)
+}
+
+func (m *metricsClient) WriteJson(v interface{}) error {
+	m.out += jsonSize(v)
+	return m.ProtocolClient.WriteJson(v)
+}
+
+func (m *metricsClient) WriteInterface(v interface{}) error {
+	m.out += jsonSize(v)
+	return m.ProtocolClient.WriteInterface(v)
+}
+
+func jsonSize(v interface{}) int {
+	b, _ := json.Marshal(v)
+	return len(b)
+}
+
+// measured wraps the handler of a command so that every run sent by a client
+// is counted, pipeline stages are counted as part of sh
+func (t *TermBackend) measured(name string, handler func(interface{}, server.ProtocolClient) error) func(interface{}, server.ProtocolClient) error {
+	t.metrics.add(name)
+	return func(data interface{}, client server.ProtocolClient) error {
+		start := time.Now()
+		mc := &metricsClient{ProtocolClient: client}
+		err := handler(data, mc)
+
+		d, _ := data.([][]byte)
+		in := 0
+		for _, arg := range d {
+			in += len(arg)
+		}
+		m := t.metrics
+		m.calls.Inc(name)
+		if err != nil || mc.err != nil {
+			m.errors.Inc(name)
+		}
+		m.bytesIn.Add(float64(in), name)
+		m.bytesOut.Add(float64(mc.out), name)
+		m.duration.ObserveSince(start, name)
+		return err
+	}
+}
+
+// Metrics shows the counts, errors, latency and sizes of every command
+func (t *TermBackend) Metrics(data interface{}, client server.ProtocolClient) error {
+	d, _ := data.([][]byte)
+	if len(d) > 1 || len(d) == 1 && string(d[0]) != "prometheus" {
+		t.writeError(client, errors.New("metrics takes an optional format ("+metricsUsage+")"))
+		return nil
+	}
+	if len(d) == 1 {
+		var out bytes.Buffer
+		t.metrics.registry.WriteTo(&out)
+		client.WriteBytes(out.Bytes())
+		client.Flush()
+		return nil
+	}
+	client.WriteJson(t.metrics.Stats(t.metrics.Clients()))
+	client.Flush()
+	return nil
+}
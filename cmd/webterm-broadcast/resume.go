@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resume holds the greeting text loaded from the home directory, it is
+// reloaded whenever the file changes on disk
+type Resume struct {
+	sync.Mutex
+
+	fullPath string
+	modTime  time.Time
+	size     int64
+	text     []byte
+}
+
+// Text returns the rendered greeting, reloading the file first if it changed
+func (r *Resume) Text() []byte {
+	r.Lock()
+	defer r.Unlock()
+
+	info, err := os.Stat(r.fullPath)
+	if err != nil {
+		r.text = []byte{}
+		r.modTime = time.Time{}
+		return r.text
+	}
+	if r.text != nil && info.ModTime().Equal(r.modTime) && info.Size() == r.size {
+		return r.text
+	}
+
+	content, err := ioutil.ReadFile(r.fullPath)
+	if err != nil {
+		return r.text
+	}
+	ext := strings.ToLower(filepath.Ext(r.fullPath))
+	if ext == ".md" || ext == ".markdown" {
+		content = renderMarkdown(content)
+	}
+	r.text = content
+	r.modTime = info.ModTime()
+	r.size = info.Size()
+	return r.text
+}
+
+var (
+	mdImage    = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	mdLink     = regexp.MustCompile(`\[([^\]]*)\]\(([^)]*)\)`)
+	mdStrong   = regexp.MustCompile(`(\*\*|__)(.+?)(\*\*|__)`)
+	mdEmphasis = regexp.MustCompile(`(^|[^\w*])[*_]([^*_\s][^*_]*?)[*_]`)
+	mdCode     = regexp.MustCompile("`([^`]*)`")
+	mdHeading  = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	mdBullet   = regexp.MustCompile(`^(\s*)[*+-]\s+(.*)$`)
+	mdRule     = regexp.MustCompile(`^\s*([-*_]\s*){3,}$`)
+)
+
+// renderMarkdown turns markdown into plain text suitable for a terminal
+func renderMarkdown(src []byte) []byte {
+	var out bytes.Buffer
+	fenced := false
+	lines := strings.Split(strings.Replace(string(src), "\r\n", "\n", -1), "\n")
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			fenced = !fenced
+			continue
+		}
+		if fenced {
+			out.WriteString("    " + line + "\n")
+			continue
+		}
+
+		if m := mdHeading.FindStringSubmatch(line); m != nil {
+			title := renderInline(m[2])
+			switch len(m[1]) {
+			case 1:
+				out.WriteString(strings.ToUpper(title) + "\n" + strings.Repeat("=", len(title)) + "\n")
+			case 2:
+				out.WriteString(title + "\n" + strings.Repeat("-", len(title)) + "\n")
+			default:
+				out.WriteString(title + "\n")
+			}
+		} else if mdRule.MatchString(line) {
+			out.WriteString(strings.Repeat("-", 40) + "\n")
+		} else if m := mdBullet.FindStringSubmatch(line); m != nil {
+			out.WriteString(m[1] + "  * " + renderInline(m[2]) + "\n")
+		} else if strings.HasPrefix(line, ">") {
+			out.WriteString("  | " + renderInline(strings.TrimSpace(strings.TrimPrefix(line, ">"))) + "\n")
+		} else {
+			out.WriteString(renderInline(line) + "\n")
+		}
+	}
+	return bytes.TrimRight(out.Bytes(), "\n")
+}
+
+func renderInline(text string) string {
+	text = mdImage.ReplaceAllString(text, "$1")
+	text = mdLink.ReplaceAllString(text, "$1 ($2)")
+	text = mdStrong.ReplaceAllString(text, "$2")
+	text = mdEmphasis.ReplaceAllString(text, "$1$2")
+	text = mdCode.ReplaceAllString(text, "$1")
+	return text
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrOutsideRoot is returned when a path would resolve outside of the sandbox root
+var ErrOutsideRoot = errors.New("permission denied, path is outside of the home directory")
+
+// ErrSymlink is returned for paths through a symlink when symlinks are not followed
+var ErrSymlink = errors.New("permission denied, symlinks are not followed")
+
+// PathError records a failed term command along with the path given by the client
+type PathError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *PathError) Error() string {
+	return e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+// newPathError wraps the given error so that it only references the client path,
+// stripping any absolute server locations reported by the os package
+func newPathError(op, name string, err error) error {
+	if pe, ok := err.(*PathError); ok {
+		return pe
+	}
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return &PathError{op, name, err}
+}
+
+// SandboxConfig sets what the sandbox lets clients reach
+type SandboxConfig struct {
+	FollowSymlinks bool `toml:"follow_symlinks"` // follow symlinks that stay inside of the root
+	AllowFSRoot    bool `toml:"allow_fs_root"`   // allow the root of the filesystem as the root
+}
+
+// Sandbox resolves client supplied paths so that they never escape the root directory
+type Sandbox struct {
+	root           string
+	followSymlinks bool
+}
+
+// NewSandbox returns a sandbox jailed to the fully resolved root directory,
+// the root of the filesystem is refused unless the config allows it
+func NewSandbox(root string, cfg SandboxConfig) (*Sandbox, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New(root + " is not a directory")
+	}
+	if filepath.Dir(root) == root && !cfg.AllowFSRoot {
+		return nil, errors.New("refusing to serve the root of the filesystem " + root + " (see sandbox.allow_fs_root)")
+	}
+
+	return &Sandbox{root, cfg.FollowSymlinks}, nil
+}
+
+// Root is the absolute location of the sandbox on disk
+func (s *Sandbox) Root() string {
+	return s.root
+}
+
+// Resolve cleans the given name relative to the root directory, rejecting any
+// path that escapes the root either through .. elements or symlinks (or goes
+// through any symlink when they are not followed). The returned path is the
+// absolute location on disk with symlinks evaluated. Paths that do not exist
+// yet resolve through their nearest existing parent.
+func (s *Sandbox) Resolve(op, name string) (string, error) {
+	if name == "" {
+		name = "."
+	}
+	if strings.IndexByte(name, 0) >= 0 {
+		return "", &PathError{op, name, errors.New("invalid argument")}
+	}
+
+	// absolute paths are relative to the sandbox root, not the server
+	sep := string(filepath.Separator)
+	rel := filepath.Clean(strings.TrimLeft(filepath.FromSlash(name), sep))
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &PathError{op, name, ErrOutsideRoot}
+	}
+
+	full := filepath.Join(s.root, rel)
+	resolved, err := s.evalSymlinks(full)
+	if err != nil {
+		return "", newPathError(op, name, err)
+	}
+	if !s.contains(resolved) {
+		return "", &PathError{op, name, ErrOutsideRoot}
+	}
+	if !s.followSymlinks && resolved != full {
+		return "", &PathError{op, name, ErrSymlink}
+	}
+
+	return resolved, nil
+}
+
+// ResolveNoFollow resolves the parent directory of name like Resolve but
+// leaves the final element alone, so that commands such as rm or mv act on a
+// symlink itself rather than on its target
+func (s *Sandbox) ResolveNoFollow(op, name string) (string, error) {
+	rel := path.Clean(strings.TrimLeft(filepath.ToSlash(name), "/"))
+	if rel == "." {
+		return s.Resolve(op, name)
+	}
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", &PathError{op, name, ErrOutsideRoot}
+	}
+
+	parent, err := s.Resolve(op, path.Dir(rel))
+	if err != nil {
+		if pe, ok := err.(*PathError); ok {
+			pe.Path = name
+		}
+		return "", err
+	}
+	return filepath.Join(parent, path.Base(rel)), nil
+}
+
+// Rel returns the given absolute path as it should be shown to clients
+func (s *Sandbox) Rel(full string) string {
+	rel, err := filepath.Rel(s.root, full)
+	if err != nil || rel == "." {
+		return "/"
+	}
+	return "/" + filepath.ToSlash(rel)
+}
+
+// IsRoot reports whether the given resolved path is the sandbox root itself
+func (s *Sandbox) IsRoot(full string) bool {
+	return filepath.Clean(full) == s.root
+}
+
+func (s *Sandbox) contains(full string) bool {
+	if full == s.root {
+		return true
+	}
+	return strings.HasPrefix(full, s.root+string(filepath.Separator))
+}
+
+// evalSymlinks evaluates the symlinks in full, walking up to the nearest
+// existing parent for any trailing elements that do not exist yet
+func (s *Sandbox) evalSymlinks(full string) (string, error) {
+	missing := []string{}
+	current := full
+	for {
+		resolved, err := filepath.EvalSymlinks(current)
+		if err == nil {
+			for i := len(missing) - 1; i >= 0; i-- {
+				resolved = filepath.Join(resolved, missing[i])
+			}
+			return resolved, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		// a dangling symlink must not be followed to a location we cannot verify
+		if info, lerr := os.Lstat(current); lerr == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", ErrOutsideRoot
+		}
+
+		parent := filepath.Dir(current)
+		if parent == current {
+			return "", err
+		}
+		missing = append(missing, filepath.Base(current))
+		current = parent
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testSandbox returns a sandbox over a temporary home directory holding
+// notes.txt, docs/readme.md and symlinks pointing inside and outside of it
+func testSandbox(t *testing.T) (*Sandbox, string) {
+	tmp, err := ioutil.TempDir("", "webterm-sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmp) })
+
+	home := filepath.Join(tmp, "home")
+	outside := filepath.Join(tmp, "outside")
+	for _, dir := range []string{filepath.Join(home, "docs"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{filepath.Join(home, "notes.txt"), filepath.Join(home, "docs", "readme.md"), filepath.Join(outside, "secret")} {
+		if err := ioutil.WriteFile(file, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"inside":   "docs",
+		"escape":   outside,
+		"relative": "../outside/secret",
+		"dangling": filepath.Join(outside, "missing"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(home, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sandbox, err := NewSandbox(home, SandboxConfig{FollowSymlinks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sandbox, sandbox.Root()
+}
+
+func TestSandboxResolve(t *testing.T) {
+	sandbox, root := testSandbox(t)
+	tests := []struct {
+		name string
+		want string // relative to the root, empty when the path is rejected
+	}{
+		{"", "."},
+		{"/", "."},
+		{"notes.txt", "notes.txt"},
+		{"/notes.txt", "notes.txt"},
+		{"docs/../notes.txt", "notes.txt"},
+		{"docs/new.txt", "docs/new.txt"},
+		{"new/dir/file", "new/dir/file"},
+		{"inside/readme.md", "docs/readme.md"},
+		{"..", ""},
+		{"../outside/secret", ""},
+		{"docs/../../outside", ""},
+		{"/../outside", ""},
+		{"/etc/passwd", "etc/passwd"},
+		{"escape", ""},
+		{"escape/secret", ""},
+		{"relative", ""},
+		{"dangling", ""},
+		{"dangling/file", ""},
+		{"bad\x00name", ""},
+	}
+	for _, test := range tests {
+		got, err := sandbox.Resolve("cat", test.name)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("Resolve(%q) = %q, want an error", test.name, got)
+			} else if _, ok := err.(*PathError); !ok {
+				t.Errorf("Resolve(%q) error %T, want a *PathError", test.name, err)
+			}
+			continue
+		}
+		want := filepath.Join(root, filepath.FromSlash(test.want))
+		if err != nil || got != want {
+			t.Errorf("Resolve(%q) = %q, %v, want %q", test.name, got, err, want)
+		}
+	}
+}
+
+func TestSandboxResolveNoFollow(t *testing.T) {
+	sandbox, root := testSandbox(t)
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"escape", "escape"},
+		{"dangling", "dangling"},
+		{"inside", "inside"},
+		{"docs/readme.md", "docs/readme.md"},
+		{"escape/secret", ""},
+		{"../outside", ""},
+	}
+	for _, test := range tests {
+		got, err := sandbox.ResolveNoFollow("rm", test.name)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("ResolveNoFollow(%q) = %q, want an error", test.name, got)
+			}
+			continue
+		}
+		want := filepath.Join(root, filepath.FromSlash(test.want))
+		if err != nil || got != want {
+			t.Errorf("ResolveNoFollow(%q) = %q, %v, want %q", test.name, got, err, want)
+		}
+	}
+}
+
+func TestSandboxRel(t *testing.T) {
+	sandbox, root := testSandbox(t)
+	tests := []struct {
+		full, want string
+	}{
+		{root, "/"},
+		{filepath.Join(root, "notes.txt"), "/notes.txt"},
+		{filepath.Join(root, "docs", "readme.md"), "/docs/readme.md"},
+	}
+	for _, test := range tests {
+		if got := sandbox.Rel(test.full); got != test.want {
+			t.Errorf("Rel(%q) = %q, want %q", test.full, got, test.want)
+		}
+	}
+	if !sandbox.IsRoot(root) || sandbox.IsRoot(filepath.Join(root, "docs")) {
+		t.Error("IsRoot does not match the root only")
+	}
+}
+
+func TestSandboxWithoutSymlinks(t *testing.T) {
+	sandbox, root := testSandbox(t)
+	sandbox, err := NewSandbox(root, SandboxConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		allow bool
+	}{
+		{"notes.txt", true},
+		{"docs/readme.md", true},
+		{"docs/new.txt", true},
+		{"inside", false},
+		{"inside/readme.md", false},
+		{"inside/new.txt", false},
+	}
+	for _, test := range tests {
+		got, err := sandbox.Resolve("cat", test.name)
+		if allowed := err == nil; allowed != test.allow {
+			t.Errorf("Resolve(%q) = %q, %v, want allowed %v", test.name, got, err, test.allow)
+		}
+	}
+	if _, err := sandbox.ResolveNoFollow("rm", "inside"); err != nil {
+		t.Errorf("ResolveNoFollow of a symlink failed: %v", err)
+	}
+}
+
+func TestSandboxRefusesFilesystemRoot(t *testing.T) {
+	if _, err := NewSandbox("/", SandboxConfig{}); err == nil {
+		t.Error("NewSandbox(/) succeeded")
+	}
+	if _, err := NewSandbox("/", SandboxConfig{AllowFSRoot: true}); err != nil {
+		t.Errorf("NewSandbox(/) with allow_fs_root failed: %v", err)
+	}
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nyxtom/broadcast/server"
+	"github.com/nyxtom/webterm/glob"
+)
+
+const grepUsage = "grep [-i] [-n] [-r] [-l] [-a] [-C n] pattern [path...]"
+const findUsage = "find [path...] [-name glob] [-type f|d] [-newer file] [-size [+|-]N[k|M|G]]"
+
+// maxSearchResults caps the number of matches or files returned by grep and find
+const maxSearchResults = 5000
+
+// searchBatchSize is how many matches or files grep and find write per reply
+const searchBatchSize = 100
+
+// binarySniffLen is how much of a file is inspected to decide whether it is binary
+const binarySniffLen = 8000
+
+// GrepMatch is a single line matched by grep
+type GrepMatch struct {
+	File   string   `json:"file"`
+	Line   int      `json:"line"`
+	Column int      `json:"column"`
+	Text   string   `json:"text"`
+	Before []string `json:"before,omitempty"`
+	After  []string `json:"after,omitempty"`
+}
+
+// GrepResult is a batch of the reply of grep, files is only set when listing
+// file names (-l). Every batch but the last has more set, see More.
+type GrepResult struct {
+	Numbers   bool        `json:"numbers"`
+	Matches   []GrepMatch `json:"matches"`
+	Files     []string    `json:"files,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+	More      bool        `json:"more,omitempty"`
+}
+
+func newGrepResult(opts *grepOptions) *GrepResult {
+	result := &GrepResult{Numbers: opts.numbers, Matches: []GrepMatch{}}
+	if opts.filesOnly {
+		result.Files = []string{}
+	}
+	return result
+}
+
+// PipeText renders the matches like grep does when used inside of a pipeline
+func (r *GrepResult) PipeText() []byte {
+	var out bytes.Buffer
+	if r.Files != nil {
+		for _, f := range r.Files {
+			out.WriteString(f + "\n")
+		}
+		return out.Bytes()
+	}
+	for _, m := range r.Matches {
+		prefix := ""
+		if m.File != "" {
+			prefix = m.File + ":"
+		}
+		if r.Numbers {
+			prefix += strconv.Itoa(m.Line) + ":"
+		}
+		out.WriteString(prefix + m.Text + "\n")
+	}
+	return out.Bytes()
+}
+
+type grepOptions struct {
+	ignoreCase bool
+	numbers    bool
+	recursive  bool
+	filesOnly  bool
+	binary     bool
+	context    int
+	pattern    *regexp.Regexp
+	paths      []string
+}
+
+func parseGrepOptions(d [][]byte) (*grepOptions, error) {
+	opts := &grepOptions{}
+	args := []string{}
+	done := false
+	for i := 0; i < len(d); i++ {
+		a := string(d[i])
+		if done || len(a) < 2 || a[0] != '-' {
+			args = append(args, a)
+			continue
+		}
+		if a == "--" {
+			done = true
+			continue
+		}
+		for j, c := range a[1:] {
+			switch c {
+			case 'i':
+				opts.ignoreCase = true
+			case 'n':
+				opts.numbers = true
+			case 'r':
+				opts.recursive = true
+			case 'l':
+				opts.filesOnly = true
+			case 'a':
+				opts.binary = true
+			case 'C':
+				// the context may be attached (-C2) or the next argument (-C 2)
+				value := a[j+2:]
+				if value == "" {
+					if i+1 >= len(d) {
+						return nil, errors.New("grep: option requires an argument -- 'C'")
+					}
+					i++
+					value = string(d[i])
+				}
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					return nil, errors.New("grep: invalid context length '" + value + "'")
+				}
+				opts.context = n
+			default:
+				return nil, errors.New("grep: invalid option -- '" + string(c) + "'")
+			}
+			if c == 'C' {
+				break
+			}
+		}
+	}
+
+	if len(args) == 0 {
+		return nil, errors.New("grep takes at least 1 parameter (" + grepUsage + ")")
+	}
+	expr := glob.Unescape(args[0])
+	if opts.ignoreCase {
+		expr = "(?i)" + expr
+	}
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, errors.New("grep: " + err.Error())
+	}
+	opts.pattern = pattern
+	opts.paths = args[1:]
+	return opts, nil
+}
+
+func (t *TermBackend) Grep(data interface{}, client server.ProtocolClient) error {
+	d, _ := data.([][]byte)
+	opts, err := parseGrepOptions(d)
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+
+	// matches are written a batch at a time as they are found, sent counts
+	// those of the batches written so far
+	result := newGrepResult(opts)
+	sent := 0
+	emit := func(m GrepMatch) bool {
+		n := len(result.Matches) + len(result.Files)
+		if sent+n >= maxSearchResults {
+			result.Truncated = true
+			return false
+		}
+		if n >= searchBatchSize {
+			result.More = true
+			writeBatch(client, result)
+			sent += n
+			result = newGrepResult(opts)
+		}
+		if opts.filesOnly {
+			result.Files = append(result.Files, m.File)
+			return false
+		}
+		result.Matches = append(result.Matches, m)
+		return true
+	}
+
+	stdin, hasStdin := stdinOf(client)
+	if len(opts.paths) == 0 && hasStdin {
+		grepReader(bytes.NewReader(stdin), "", opts, emit)
+		client.WriteJson(result)
+		client.Flush()
+		return nil
+	}
+	if len(opts.paths) == 0 {
+		if !opts.recursive {
+			t.writeError(client, errors.New("grep takes a path unless used with -r or in a pipeline ("+grepUsage+")"))
+			return nil
+		}
+		opts.paths = []string{"."}
+	}
+
+	names, err := t.expandArgs(client, "grep", opts.paths)
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+	errs := PathErrors{}
+	for _, name := range names {
+		if result.Truncated {
+			break
+		}
+		fullPath, err := t.resolve(client, "grep", name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			errs = append(errs, newPathError("grep", name, err))
+			continue
+		}
+		if !info.IsDir() {
+			if err := grepFile(fullPath, glob.Unescape(name), opts, emit); err != nil {
+				errs = append(errs, newPathError("grep", name, err))
+			}
+			continue
+		}
+		if !opts.recursive {
+			errs = append(errs, &PathError{"grep", name, errors.New("is a directory")})
+			continue
+		}
+		err = t.walk(fullPath, glob.Unescape(name), func(file, display string, info os.FileInfo) bool {
+			if info.Mode().IsRegular() {
+				grepFile(file, display, opts, emit)
+			}
+			return !result.Truncated
+		})
+		if err != nil {
+			errs = append(errs, newPathError("grep", name, err))
+		}
+	}
+
+	if len(errs) > 0 && sent == 0 && len(result.Matches) == 0 && len(result.Files) == 0 {
+		t.writeError(client, errs)
+		return nil
+	}
+	client.WriteJson(result)
+	client.Flush()
+	return nil
+}
+
+func grepFile(fullPath, display string, opts *grepOptions, emit func(GrepMatch) bool) error {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if !opts.binary {
+		head, _ := r.Peek(binarySniffLen)
+		if bytes.IndexByte(head, 0) >= 0 {
+			return nil
+		}
+	}
+	return grepReader(r, display, opts, emit)
+}
+
+// grepReader scans the reader line by line so that large files are never held
+// in memory, emit is called for every match until it returns false
+func grepReader(r io.Reader, display string, opts *grepOptions, emit func(GrepMatch) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	before := []string{}
+	pending := []*GrepMatch{}
+
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		text := scanner.Text()
+
+		// fill in the trailing context of earlier matches
+		for len(pending) > 0 && len(pending[0].After) >= opts.context {
+			if !emit(*pending[0]) {
+				return nil
+			}
+			pending = pending[1:]
+		}
+		for _, m := range pending {
+			if len(m.After) < opts.context {
+				m.After = append(m.After, text)
+			}
+		}
+
+		matched := opts.pattern.FindStringIndex(text)
+		if matched != nil {
+			m := &GrepMatch{File: display, Line: lineNo, Column: matched[0] + 1, Text: text}
+			if opts.context > 0 {
+				m.Before = append([]string{}, before...)
+				pending = append(pending, m)
+			} else if !emit(*m) {
+				return nil
+			}
+		}
+
+		if opts.context > 0 {
+			before = append(before, text)
+			if len(before) > opts.context {
+				before = before[1:]
+			}
+		}
+	}
+	for _, m := range pending {
+		if !emit(*m) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// FindResult is a batch of the reply of find, entry names are the paths of
+// the files found. Every batch but the last has more set, see More.
+type FindResult struct {
+	Found     []FileEntry `json:"found"`
+	Truncated bool        `json:"truncated,omitempty"`
+	More      bool        `json:"more,omitempty"`
+}
+
+// PipeText lists the paths found one per line
+func (r *FindResult) PipeText() []byte {
+	var out bytes.Buffer
+	for _, entry := range r.Found {
+		out.WriteString(entry.Name + "\n")
+	}
+	return out.Bytes()
+}
+
+type findOptions struct {
+	name     string
+	fileType string
+	newer    time.Time
+	hasNewer bool
+	size     int64
+	sizeCmp  int
+	hasSize  bool
+	paths    []string
+}
+
+func (t *TermBackend) parseFindOptions(client server.ProtocolClient, d [][]byte) (*findOptions, error) {
+	opts := &findOptions{}
+	for i := 0; i < len(d); i++ {
+		a := string(d[i])
+		if !strings.HasPrefix(a, "-") || len(a) < 2 {
+			opts.paths = append(opts.paths, a)
+			continue
+		}
+		if i+1 >= len(d) {
+			return nil, errors.New("find: missing argument to " + a)
+		}
+		i++
+		value := string(d[i])
+		switch a {
+		case "-name":
+			opts.name = glob.Unescape(value)
+			if _, err := path.Match(opts.name, ""); err != nil {
+				return nil, errors.New("find: invalid pattern " + value)
+			}
+		case "-type":
+			if value != "f" && value != "d" {
+				return nil, errors.New("find: unknown argument to -type: " + value)
+			}
+			opts.fileType = value
+		case "-newer":
+			fullPath, err := t.resolve(client, "find", value)
+			if err != nil {
+				return nil, err
+			}
+			info, err := os.Stat(fullPath)
+			if err != nil {
+				return nil, newPathError("find", value, err)
+			}
+			opts.newer = info.ModTime()
+			opts.hasNewer = true
+		case "-size":
+			size, cmp, err := parseSize(value)
+			if err != nil {
+				return nil, err
+			}
+			opts.size, opts.sizeCmp, opts.hasSize = size, cmp, true
+		default:
+			return nil, errors.New("find: unknown predicate " + a)
+		}
+	}
+	if len(opts.paths) == 0 {
+		opts.paths = []string{"."}
+	}
+	return opts, nil
+}
+
+// parseSize parses find sizes such as +10k, -1M or 512 into bytes and a comparison
+func parseSize(value string) (int64, int, error) {
+	cmp := 0
+	v := value
+	if strings.HasPrefix(v, "+") {
+		cmp, v = 1, v[1:]
+	} else if strings.HasPrefix(v, "-") {
+		cmp, v = -1, v[1:]
+	}
+	unit := int64(1)
+	if v != "" {
+		switch v[len(v)-1] {
+		case 'c':
+			v = v[:len(v)-1]
+		case 'k':
+			unit, v = 1<<10, v[:len(v)-1]
+		case 'M':
+			unit, v = 1<<20, v[:len(v)-1]
+		case 'G':
+			unit, v = 1<<30, v[:len(v)-1]
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, 0, errors.New("find: invalid size " + value)
+	}
+	return n * unit, cmp, nil
+}
+
+func (o *findOptions) matches(info os.FileInfo) bool {
+	if o.name != "" {
+		if ok, _ := path.Match(o.name, info.Name()); !ok {
+			return false
+		}
+	}
+	if o.fileType == "f" && !info.Mode().IsRegular() {
+		return false
+	}
+	if o.fileType == "d" && !info.IsDir() {
+		return false
+	}
+	if o.hasNewer && !info.ModTime().After(o.newer) {
+		return false
+	}
+	if o.hasSize {
+		switch {
+		case o.sizeCmp > 0 && info.Size() <= o.size:
+			return false
+		case o.sizeCmp < 0 && info.Size() >= o.size:
+			return false
+		case o.sizeCmp == 0 && info.Size() != o.size:
+			return false
+		}
+	}
+	return true
+}
+
+func (t *TermBackend) Find(data interface{}, client server.ProtocolClient) error {
+	d, _ := data.([][]byte)
+	opts, err := t.parseFindOptions(client, d)
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+	names, err := t.expandArgs(client, "find", opts.paths)
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+
+	result := &FindResult{Found: []FileEntry{}}
+	sent := 0
+	errs := PathErrors{}
+	for _, name := range names {
+		fullPath, err := t.resolve(client, "find", name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		err = t.walk(fullPath, glob.Unescape(name), func(file, display string, info os.FileInfo) bool {
+			if opts.matches(info) {
+				if sent+len(result.Found) >= maxSearchResults {
+					result.Truncated = true
+					return false
+				}
+				if len(result.Found) >= searchBatchSize {
+					result.More = true
+					writeBatch(client, result)
+					sent += len(result.Found)
+					result = &FindResult{Found: []FileEntry{}}
+				}
+				entry := t.fileEntry(file, info)
+				entry.Name = display
+				result.Found = append(result.Found, entry)
+			}
+			return true
+		})
+		if err != nil {
+			errs = append(errs, newPathError("find", name, err))
+		}
+	}
+
+	if len(errs) > 0 && sent == 0 && len(result.Found) == 0 {
+		t.writeError(client, errs)
+		return nil
+	}
+	client.WriteJson(result)
+	client.Flush()
+	return nil
+}
+
+// writeBatch writes a batch of a streamed reply as soon as it is complete
+func writeBatch(client server.ProtocolClient, batch interface{}) {
+	client.WriteJson(batch)
+	client.Flush()
+}
+
+// More reads the next batch of a streamed reply, grep and find write their
+// results a batch at a time with more set on every batch but the last. The
+// batches are written as they are found, more itself is fire and forget and
+// never replies so the reply a client reads after sending it is the next batch.
+func (t *TermBackend) More(data interface{}, client server.ProtocolClient) error {
+	return nil
+}
+
+// walk visits fullPath and everything below it without following symlinks,
+// skipping the state directory. fn receives the path on disk, the path as shown
+// to the client and the lstat info, returning false stops the walk.
+func (t *TermBackend) walk(fullPath, display string, fn func(file, display string, info os.FileInfo) bool) error {
+	if _, err := os.Lstat(fullPath); err != nil {
+		return err
+	}
+
+	stop := errors.New("stop")
+	err := filepath.Walk(fullPath, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			// unreadable entries are skipped rather than failing the whole walk
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if t.isState(file) {
+			return filepath.SkipDir
+		}
+		rel, _ := filepath.Rel(fullPath, file)
+		shown := display
+		if rel != "." {
+			shown = joinDisplay(display, filepath.ToSlash(rel))
+		}
+		if !fn(file, shown, info) {
+			return stop
+		}
+		return nil
+	})
+	if err == stop {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSearchStreamsBatches(t *testing.T) {
+	backend, home, _ := testBackend(t)
+	lines := make([]string, 2*searchBatchSize+10)
+	for i := range lines {
+		lines[i] = "match"
+	}
+	write(t, filepath.Join(home, "big.txt"), strings.Join(lines, "\n"))
+	for i := 0; i < searchBatchSize+1; i++ {
+		write(t, filepath.Join(home, "files", fmt.Sprintf("%03d.txt", i)), "x")
+	}
+
+	c := run(backend, "grep", "match", "big.txt")
+	if len(c.replies) != 3 {
+		t.Fatalf("grep wrote %d replies, want 3", len(c.replies))
+	}
+	total := 0
+	for i, reply := range c.replies {
+		result := reply.(*GrepResult)
+		if more := i < len(c.replies)-1; result.More != more {
+			t.Errorf("batch %d has more %v", i, result.More)
+		}
+		total += len(result.Matches)
+	}
+	if total != len(lines) {
+		t.Errorf("grep found %d matches, want %d", total, len(lines))
+	}
+
+	c = run(backend, "find", "files", "-type", "f")
+	if len(c.replies) != 2 {
+		t.Fatalf("find wrote %d replies, want 2", len(c.replies))
+	}
+	first, last := c.replies[0].(*FindResult), c.replies[1].(*FindResult)
+	if !first.More || last.More || len(first.Found)+len(last.Found) != searchBatchSize+1 {
+		t.Errorf("find batches %d (more %v) and %d (more %v)", len(first.Found), first.More, len(last.Found), last.More)
+	}
+
+	if c := run(backend, "grep", "match", "missing.txt"); len(c.errs) != 1 || len(c.replies) != 0 {
+		t.Errorf("grep of a missing file wrote %v and %v", c.replies, c.errs)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nyxtom/broadcast/server"
+)
+
+// sessionIdleTimeout is how long the session kept under a key is kept around
+// after a connection last continued it
+const sessionIdleTimeout = 30 * time.Minute
+
+// Session holds the per connection state for a term client
+type Session struct {
+	sync.Mutex
+
+	cwd      string   // working directory relative to the sandbox root ("/" is home)
+	oldCwd   string   // previous working directory for cd -
+	dirStack []string // directories saved by pushd, top of the stack last
+	lastSeen time.Time
+
+	user    string   // user identified by the web server, empty for anonymous browsers
+	roles   []string // roles of the identified user
+	trusted bool     // identified with the secret, the connection is the web server's
+}
+
+// Cwd returns the current working directory of the session
+func (s *Session) Cwd() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.cwd
+}
+
+// Chdir changes the working directory of the session, remembering the previous
+// one. Changing to the working directory itself keeps the previous one, the web
+// server does so before every command to restore the directory of the browser.
+func (s *Session) Chdir(dir string) {
+	s.Lock()
+	defer s.Unlock()
+	if dir == s.cwd {
+		return
+	}
+	s.oldCwd = s.cwd
+	s.cwd = dir
+}
+
+// Dirs returns the directory stack with the working directory first, as shown by dirs
+func (s *Session) Dirs() []string {
+	s.Lock()
+	defer s.Unlock()
+	dirs := []string{s.cwd}
+	for i := len(s.dirStack) - 1; i >= 0; i-- {
+		dirs = append(dirs, s.dirStack[i])
+	}
+	return dirs
+}
+
+// Identify sets the user of the session, see SessionStore.Rebind for the
+// directories it starts from
+func (s *Session) Identify(user string, roles []string) {
+	s.Lock()
+	defer s.Unlock()
+	s.user = user
+	s.roles = roles
+	s.trusted = true
+}
+
+// Identity returns the identified user of the session and their roles, ok is
+// false unless the connection was identified by the web server
+func (s *Session) Identity() (string, []string, bool) {
+	s.Lock()
+	defer s.Unlock()
+	return s.user, s.roles, s.trusted
+}
+
+// SessionStore tracks the sessions of all connected protocol clients
+type SessionStore struct {
+	sync.Mutex
+
+	sessions  map[server.ProtocolClient]*Session
+	shared    map[string]*Session // sessions continued by any connection, by key
+	lastSweep time.Time
+}
+
+// NewSessionStore returns an empty session store
+func NewSessionStore() *SessionStore {
+	store := new(SessionStore)
+	store.sessions = make(map[server.ProtocolClient]*Session)
+	store.shared = make(map[string]*Session)
+	store.lastSweep = time.Now()
+	return store
+}
+
+// unwrap returns the real client of commands run inside of a pipeline,
+// audited or measured, they share its session
+func unwrap(client server.ProtocolClient) server.ProtocolClient {
+	for {
+		switch c := client.(type) {
+		case *pipeClient:
+			client = c.ProtocolClient
+		case *auditClient:
+			client = c.ProtocolClient
+		case *metricsClient:
+			client = c.ProtocolClient
+		default:
+			return client
+		}
+	}
+}
+
+// Rebind gives the client a new session when key is empty, otherwise the
+// session kept under key (created if necessary). Connections are shared
+// between browsers by the web server, a browser keeps its working directory,
+// previous directory and directory stack from one command to the next by
+// continuing the same session whichever connection runs its commands.
+func (store *SessionStore) Rebind(client server.ProtocolClient, key string) *Session {
+	client = unwrap(client)
+
+	store.Lock()
+	defer store.Unlock()
+
+	return store.rebind(client, key)
+}
+
+// RebindAnonymous rebinds the client like Rebind for connections that have not
+// been identified, ok is false when the session kept under key is that of an
+// identified user as continuing it would give the client the user's roles
+func (store *SessionStore) RebindAnonymous(client server.ProtocolClient, key string) (*Session, bool) {
+	client = unwrap(client)
+
+	store.Lock()
+	defer store.Unlock()
+
+	if session, ok := store.shared[key]; ok && key != "" {
+		if _, _, trusted := session.Identity(); trusted {
+			return nil, false
+		}
+	}
+	return store.rebind(client, key), true
+}
+
+func (store *SessionStore) rebind(client server.ProtocolClient, key string) *Session {
+	session, ok := store.shared[key]
+	if key == "" || !ok {
+		session = &Session{cwd: "/", oldCwd: "/"}
+	}
+	if key != "" {
+		store.shared[key] = session
+	}
+	session.lastSeen = time.Now()
+	store.sessions[client] = session
+	return session
+}
+
+// Get returns the session for the given client, creating it if necessary
+func (store *SessionStore) Get(client server.ProtocolClient) *Session {
+	client = unwrap(client)
+
+	store.Lock()
+	defer store.Unlock()
+
+	now := time.Now()
+	if now.Sub(store.lastSweep) > time.Minute {
+		store.sweep(now)
+	}
+
+	session, ok := store.sessions[client]
+	if !ok {
+		session = &Session{cwd: "/", oldCwd: "/"}
+		store.sessions[client] = session
+	}
+	session.lastSeen = now
+	return session
+}
+
+// Drop forgets the session of a client that has disconnected, the session
+// kept under a key stays around for the next connection continuing it
+func (store *SessionStore) Drop(client server.ProtocolClient) {
+	client = unwrap(client)
+
+	store.Lock()
+	defer store.Unlock()
+	delete(store.sessions, client)
+}
+
+// sweep drops the sessions kept under a key that no connection has continued
+// in a while, those of connected clients are only dropped once they disconnect
+func (store *SessionStore) sweep(now time.Time) {
+	for key, session := range store.shared {
+		if now.Sub(session.lastSeen) > sessionIdleTimeout {
+			delete(store.shared, key)
+		}
+	}
+	store.lastSweep = now
+}
+
+// sessionProtocol stands in for the protocol of the server, dropping the
+// session of every client it runs once the client disconnects
+type sessionProtocol struct {
+	server.BroadcastServerProtocol
+
+	store *SessionStore
+}
+
+func (p *sessionProtocol) RunClient(client server.ProtocolClient) {
+	defer p.store.Drop(client)
+	p.BroadcastServerProtocol.RunClient(client)
+}
+
+// Track wraps the protocol so that the sessions of its clients are dropped
+// when they disconnect, the store is then passed on to the term backend
+func (store *SessionStore) Track(p server.BroadcastServerProtocol) server.BroadcastServerProtocol {
+	return &sessionProtocol{BroadcastServerProtocol: p, store: store}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionRebind(t *testing.T) {
+	store := NewSessionStore()
+	first, second := &testClient{}, &testClient{}
+
+	store.Get(first).Chdir("/docs")
+	if cwd := store.Rebind(first, "").Cwd(); cwd != "/" {
+		t.Errorf("rebinding without a key kept %q", cwd)
+	}
+
+	store.Rebind(first, "browser").Chdir("/docs")
+	if cwd := store.Rebind(second, "browser").Cwd(); cwd != "/docs" {
+		t.Errorf("continuing the key gave %q", cwd)
+	}
+	if cwd := store.Rebind(first, "other").Cwd(); cwd != "/" {
+		t.Errorf("another key gave %q", cwd)
+	}
+
+	store.Rebind(first, "user").Identify("alice", []string{"admin"})
+	if _, ok := store.RebindAnonymous(second, "user"); ok {
+		t.Error("an anonymous connection continued the session of an identified user")
+	}
+	if _, _, trusted := store.Get(second).Identity(); trusted {
+		t.Error("an anonymous connection was given the identity of a user")
+	}
+	if _, ok := store.RebindAnonymous(second, "browser"); !ok {
+		t.Error("an anonymous connection could not continue an anonymous session")
+	}
+}
+
+func TestSessionSweep(t *testing.T) {
+	store := NewSessionStore()
+	client := &testClient{}
+	session := store.Rebind(client, "browser")
+	session.Chdir("/docs")
+
+	store.sweep(time.Now().Add(2 * sessionIdleTimeout))
+	if store.Get(client) != session {
+		t.Error("the session of a connected client was swept")
+	}
+	if cwd := store.Rebind(&testClient{}, "browser").Cwd(); cwd != "/" {
+		t.Errorf("the idle key was kept with %q", cwd)
+	}
+
+	store.Drop(client)
+	if store.Get(client) == session {
+		t.Error("the session of a disconnected client was kept")
+	}
+}
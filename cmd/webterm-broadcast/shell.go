@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/nyxtom/broadcast/server"
+	"github.com/nyxtom/webterm/glob"
+)
+
+const shUsage = `sh "cmd [args...] [< file] [| cmd [args...]]... [> file|>> file]"`
+
+// stage is a single command of a pipeline along with its redirections
+type stage struct {
+	args   []string
+	input  string // file read as the input of the first stage (<)
+	output string // file written with the output of the last stage (> or >>)
+	append bool
+}
+
+// shellOperators are the characters that separate words even when not surrounded by spaces
+const shellOperators = "|<>"
+
+// parsePipeline splits a command line into the stages of a pipeline. Quoting
+// works like a regular shell, glob characters inside quotes or escaped with a
+// backslash are escaped so that they are never expanded.
+func parsePipeline(line string) ([]*stage, error) {
+	stages := []*stage{}
+	current := &stage{}
+	redirect := ""
+
+	word := []byte{}
+	inWord := false
+	flush := func() {
+		if !inWord {
+			return
+		}
+		w := string(word)
+		word = word[:0]
+		inWord = false
+		switch redirect {
+		case "":
+			current.args = append(current.args, w)
+		case "<":
+			current.input = w
+		default:
+			current.output = w
+			current.append = redirect == ">>"
+		}
+		redirect = ""
+	}
+	literal := func(c byte) {
+		if strings.IndexByte(glob.Meta, c) >= 0 {
+			word = append(word, '\\')
+		}
+		word = append(word, c)
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			flush()
+		case c == '\'':
+			inWord = true
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("sh: unterminated quote")
+			}
+			for j := i + 1; j <= i+end; j++ {
+				literal(line[j])
+			}
+			i += end + 1
+		case c == '"':
+			inWord = true
+			j := i + 1
+			for ; j < len(line) && line[j] != '"'; j++ {
+				if line[j] == '\\' && j+1 < len(line) && strings.IndexByte(`"\`, line[j+1]) >= 0 {
+					j++
+				}
+				literal(line[j])
+			}
+			if j >= len(line) {
+				return nil, errors.New("sh: unterminated quote")
+			}
+			i = j
+		case c == '\\' && i+1 < len(line):
+			inWord = true
+			i++
+			literal(line[i])
+		case strings.IndexByte(shellOperators, c) >= 0:
+			flush()
+			if redirect != "" {
+				return nil, errors.New("sh: syntax error near " + string(c))
+			}
+			if c == '|' {
+				if len(current.args) == 0 {
+					return nil, errors.New("sh: syntax error near |")
+				}
+				stages = append(stages, current)
+				current = &stage{}
+			} else if c == '>' && i+1 < len(line) && line[i+1] == '>' {
+				redirect = ">>"
+				i++
+			} else {
+				redirect = string(c)
+			}
+		default:
+			inWord = true
+			word = append(word, c)
+		}
+	}
+	flush()
+	if redirect != "" {
+		return nil, errors.New("sh: syntax error, missing file after " + redirect)
+	}
+	if len(current.args) == 0 {
+		if len(stages) == 0 {
+			return stages, nil
+		}
+		return nil, errors.New("sh: syntax error, missing command after |")
+	}
+	stages = append(stages, current)
+
+	for i, s := range stages {
+		if s.input != "" && i > 0 {
+			return nil, errors.New("sh: only the first command of a pipeline may read from a file")
+		}
+		if s.output != "" && i < len(stages)-1 {
+			return nil, errors.New("sh: only the last command of a pipeline may write to a file")
+		}
+	}
+	return stages, nil
+}
+
+// pipeClient stands in for the protocol client while a command runs inside of
+// a pipeline, it carries the output of the previous command as input and
+// captures the output of the command unless it is the last one
+type pipeClient struct {
+	server.ProtocolClient
+
+	stdin       []byte
+	hasStdin    bool
+	passthrough bool
+	out         bytes.Buffer
+	err         error
+}
+
+// pipeText is implemented by replies that have a plain text form inside of pipelines
+type pipeText interface {
+	PipeText() []byte
+}
+
+func (p *pipeClient) Flush() error {
+	if p.passthrough {
+		return p.ProtocolClient.Flush()
+	}
+	return nil
+}
+
+func (p *pipeClient) WriteError(err error) error {
+	if p.passthrough {
+		return p.ProtocolClient.WriteError(err)
+	}
+	p.err = err
+	return nil
+}
+
+func (p *pipeClient) WriteString(msg string) error {
+	if p.passthrough {
+		return p.ProtocolClient.WriteString(msg)
+	}
+	p.writeLine([]byte(msg))
+	return nil
+}
+
+func (p *pipeClient) WriteBytes(b []byte) error {
+	if p.passthrough {
+		return p.ProtocolClient.WriteBytes(b)
+	}
+	p.out.Write(b)
+	return nil
+}
+
+func (p *pipeClient) WriteInt64(num int64) error {
+	if p.passthrough {
+		return p.ProtocolClient.WriteInt64(num)
+	}
+	p.writeLine([]byte(fmt.Sprintf("%d", num)))
+	return nil
+}
+
+func (p *pipeClient) WriteFloat64(num float64) error {
+	if p.passthrough {
+		return p.ProtocolClient.WriteFloat64(num)
+	}
+	p.writeLine([]byte(fmt.Sprintf("%v", num)))
+	return nil
+}
+
+func (p *pipeClient) WriteBool(b bool) error {
+	if p.passthrough {
+		return p.ProtocolClient.WriteBool(b)
+	}
+	p.writeLine([]byte(fmt.Sprintf("%v", b)))
+	return nil
+}
+
+func (p *pipeClient) WriteNull() error {
+	if p.passthrough {
+		return p.ProtocolClient.WriteNull()
+	}
+	return nil
+}
+
+func (p *pipeClient) WriteArray(arr []interface{}) error {
+	if p.passthrough {
+		return p.ProtocolClient.WriteArray(arr)
+	}
+	for _, item := range arr {
+		p.writeLine([]byte(fmt.Sprintf("%v", item)))
+	}
+	return nil
+}
+
+func (p *pipeClient) WriteJson(v interface{}) error {
+	if p.passthrough {
+		return p.ProtocolClient.WriteJson(v)
+	}
+	if t, ok := v.(pipeText); ok {
+		p.out.Write(t.PipeText())
+		return nil
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		p.err = err
+		return err
+	}
+	p.writeLine(b)
+	return nil
+}
+
+func (p *pipeClient) writeLine(b []byte) {
+	p.out.Write(b)
+	if len(b) == 0 || b[len(b)-1] != '\n' {
+		p.out.WriteByte('\n')
+	}
+}
+
+// stdinOf returns the output of the previous command when running inside of a pipeline
+func stdinOf(client server.ProtocolClient) ([]byte, bool) {
+	if p, ok := client.(*pipeClient); ok && p.hasStdin {
+		return p.stdin, true
+	}
+	return nil, false
+}
+
+func (t *TermBackend) Shell(data interface{}, client server.ProtocolClient) error {
+	d, _ := data.([][]byte)
+	if len(d) == 0 {
+		t.writeError(client, errors.New("sh takes at least 1 parameter ("+shUsage+")"))
+		return nil
+	}
+	parts := make([]string, len(d))
+	for i, arg := range d {
+		parts[i] = string(arg)
+	}
+	stages, err := parsePipeline(strings.Join(parts, " "))
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+	if len(stages) == 0 {
+		client.WriteString("")
+		client.Flush()
+		return nil
+	}
+
+	for _, s := range stages {
+		if _, ok := t.commands[strings.ToUpper(s.args[0])]; !ok {
+			t.writeError(client, errors.New("sh: "+s.args[0]+": command not found"))
+			return nil
+		}
+	}
+
+	var input []byte
+	hasInput := false
+	if first := stages[0]; first.input != "" {
+		// reading a file into the pipeline needs the same permissions as cat
+		err := t.authorize(client, "cat")
+		var fullPath string
+		if err == nil {
+			fullPath, err = t.resolve(client, "cat", first.input)
+		}
+		if err == nil {
+			input, err = ioutil.ReadFile(fullPath)
+			err = newPathErrorOrNil("sh", first.input, err)
+		}
+		if err != nil {
+			t.writeError(client, err)
+			return nil
+		}
+		hasInput = true
+	}
+
+	last := stages[len(stages)-1]
+	for i, s := range stages {
+		pc := &pipeClient{ProtocolClient: client, stdin: input, hasStdin: hasInput}
+		pc.passthrough = i == len(stages)-1 && last.output == ""
+
+		args := make([][]byte, len(s.args)-1)
+		for j, arg := range s.args[1:] {
+			args[j] = []byte(arg)
+		}
+		// file contents are written without the escaping of their glob characters
+		if j := glob.ContentArg(s.args[0], s.args[1:]); j >= 0 {
+			args[j] = []byte(glob.Unescape(s.args[j+1]))
+		}
+		if err := t.commands[strings.ToUpper(s.args[0])](args, pc); err != nil {
+			pc.err = err
+		}
+		if pc.err != nil {
+			t.writeError(client, pc.err)
+			return nil
+		}
+		if pc.passthrough {
+			return nil
+		}
+		input = pc.out.Bytes()
+		hasInput = true
+	}
+
+	if err := t.redirect(client, last.output, input, last.append); err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+	client.WriteString("")
+	client.Flush()
+	return nil
+}
+
+// redirect writes the output of a pipeline to a file through the same sandboxed
+// path as save, which the client must be allowed to run
+func (t *TermBackend) redirect(client server.ProtocolClient, fileName string, content []byte, appendOutput bool) error {
+	if err := t.authorize(client, "save"); err != nil {
+		return err
+	}
+	fullPath, err := t.resolve(client, "save", fileName)
+	if err != nil {
+		return err
+	}
+
+	t.saveLock.Lock()
+	defer t.saveLock.Unlock()
+	if appendOutput {
+		existing, err := ioutil.ReadFile(fullPath)
+		if err != nil && !os.IsNotExist(err) {
+			return newPathError("sh", fileName, err)
+		}
+		content = append(existing, content...)
+	}
+	return newPathErrorOrNil("sh", fileName, t.storeFile(fullPath, content))
+}
+
+// newPathErrorOrNil is newPathError for errors that may be nil
+func newPathErrorOrNil(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return newPathError(op, name, err)
+}
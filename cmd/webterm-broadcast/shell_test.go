@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePipeline(t *testing.T) {
+	tests := []struct {
+		line   string
+		stages []stage
+	}{
+		{"", []stage{}},
+		{"   ", []stage{}},
+		{"ls", []stage{{args: []string{"ls"}}}},
+		{"ls -l docs", []stage{{args: []string{"ls", "-l", "docs"}}}},
+		{"cat a.txt | grep foo", []stage{
+			{args: []string{"cat", "a.txt"}},
+			{args: []string{"grep", "foo"}},
+		}},
+		{"cat a|grep b|grep c", []stage{
+			{args: []string{"cat", "a"}},
+			{args: []string{"grep", "b"}},
+			{args: []string{"grep", "c"}},
+		}},
+		{"grep foo < in.txt", []stage{{args: []string{"grep", "foo"}, input: "in.txt"}}},
+		{"ls > out.txt", []stage{{args: []string{"ls"}, output: "out.txt"}}},
+		{"ls>>out.txt", []stage{{args: []string{"ls"}, output: "out.txt", append: true}}},
+		{"grep a <in | grep b >> out", []stage{
+			{args: []string{"grep", "a"}, input: "in"},
+			{args: []string{"grep", "b"}, output: "out", append: true},
+		}},
+		{`echo "a | b" 'c > d'`, []stage{{args: []string{"echo", "a | b", "c > d"}}}},
+		{`echo "two  words" x\ y`, []stage{{args: []string{"echo", "two  words", "x y"}}}},
+		{`echo "say \"hi\""`, []stage{{args: []string{"echo", `say "hi"`}}}},
+		{`echo '' ""`, []stage{{args: []string{"echo", "", ""}}}},
+		{"ls *.go", []stage{{args: []string{"ls", "*.go"}}}},
+		{`ls "*.go" '[a]' \?`, []stage{{args: []string{"ls", `\*.go`, `\[a\]`, `\?`}}}},
+		{`cat "my file.txt" > "out file"`, []stage{{args: []string{"cat", "my file.txt"}, output: "out file"}}},
+	}
+	for _, test := range tests {
+		stages, err := parsePipeline(test.line)
+		if err != nil {
+			t.Errorf("parsePipeline(%q) failed: %v", test.line, err)
+			continue
+		}
+		got := []stage{}
+		for _, s := range stages {
+			got = append(got, *s)
+		}
+		if !reflect.DeepEqual(got, test.stages) {
+			t.Errorf("parsePipeline(%q) = %+v, want %+v", test.line, got, test.stages)
+		}
+	}
+}
+
+func TestParsePipelineErrors(t *testing.T) {
+	tests := []string{
+		`echo "unterminated`,
+		`echo 'unterminated`,
+		"| ls",
+		"ls |",
+		"ls | | ls",
+		"ls >",
+		"ls > > out",
+		"cat <",
+		"ls | grep a < in",
+		"ls > out | grep a",
+	}
+	for _, line := range tests {
+		if stages, err := parsePipeline(line); err == nil {
+			t.Errorf("parsePipeline(%q) = %+v, want an error", line, stages)
+		}
+	}
+}
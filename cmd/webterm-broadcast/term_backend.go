@@ -1,63 +1,142 @@
 package main
 
 import (
+	"encoding/base64"
 	"errors"
 	"io/ioutil"
+	"os"
 	"os/user"
 	"path"
+	"sync"
+	"unicode/utf8"
 
 	"github.com/nyxtom/broadcast/server"
+	"github.com/nyxtom/webterm/audit"
+	"github.com/nyxtom/webterm/glob"
+	"github.com/nyxtom/webterm/metrics"
+	"github.com/nyxtom/webterm/policy"
 )
 
+// TermConfig configures the term backend
+type TermConfig struct {
+	DefaultCommands bool // registers ping, echo, info and cmds
+	FileCommands    bool // registers the commands of the home directory
+
+	HomeDir      string // directory served to clients, defaults to the current user's home
+	ResumeFile   string // greeting file relative to HomeDir (markdown or plain text)
+	ResumeCmd    string // name of the command that shows the greeting
+	HistoryLimit int    // revisions kept of every saved file, 0 to keep none
+	Sandbox      SandboxConfig
+	Policy       *policy.Policy
+	Audit        *audit.Logger     // records the commands of direct connections, nil to disable
+	Metrics      *metrics.Registry // registry the command metrics are added to, nil for one of its own
+	Clients      *metrics.Gauge    // connected clients as counted by CountClients
+	Sessions     *SessionStore     // sessions tracked by SessionStore.Track, nil for a store of its own
+}
+
 type TermBackend struct {
 	server.Backend
 
-	homeDir    string
-	resumeText []byte
-	app        *server.BroadcastServer
+	homeDir  string
+	resume   *Resume
+	sandbox  *Sandbox
+	history  *History
+	sessions *SessionStore
+	policy   *policy.Policy
+	audit    *audit.Logger
+	metrics  *CommandMetrics
+	commands map[string]func(interface{}, server.ProtocolClient) error
+	help     map[string]server.Command
+	saveLock sync.Mutex
+	app      *server.BroadcastServer
+}
+
+// resolve locates the given name relative to the working directory of the client session
+func (t *TermBackend) resolve(client server.ProtocolClient, op, name string) (string, error) {
+	return t.resolveWith(t.sandbox.Resolve, client, op, name)
+}
+
+// resolveNoFollow is like resolve but does not follow a symlink in the final element
+func (t *TermBackend) resolveNoFollow(client server.ProtocolClient, op, name string) (string, error) {
+	return t.resolveWith(t.sandbox.ResolveNoFollow, client, op, name)
+}
+
+func (t *TermBackend) resolveWith(fn func(op, name string) (string, error), client server.ProtocolClient, op, name string) (string, error) {
+	// clients escape the glob characters of quoted arguments
+	name = glob.Unescape(name)
+	joined := name
+	if !path.IsAbs(name) {
+		// joined without cleaning so the sandbox can reject .. escapes
+		joined = t.sessions.Get(client).Cwd() + "/" + name
+	}
+	fullPath, err := fn(op, joined)
+	if pe, ok := err.(*PathError); ok {
+		pe.Path = name
+	}
+	if err == nil && t.isState(fullPath) {
+		// the history store can only be reached through history, show and revert
+		err = &PathError{op, name, ErrStateDir}
+	}
+	if err == nil {
+		// checked after resolving so that symlinks can not be used to reach other paths
+		err = t.authorizePath(client, op, t.sandbox.Rel(fullPath))
+	}
+	return fullPath, err
+}
+
+// writeError reports the error to the client in the same way for all term commands
+func (t *TermBackend) writeError(client server.ProtocolClient, err error) {
+	client.WriteError(err)
+	client.Flush()
 }
 
 func (t *TermBackend) ShowResume(data interface{}, client server.ProtocolClient) error {
-	client.WriteBytes(t.resumeText)
+	client.WriteBytes(t.resume.Text())
 	client.Flush()
 	return nil
 }
 
 func (t *TermBackend) CatFile(data interface{}, client server.ProtocolClient) error {
 	d, _ := data.([][]byte)
-	if len(d) > 0 {
-		fileName := string(d[0])
-		content, err := ioutil.ReadFile(path.Join(t.homeDir, fileName))
+	if stdin, ok := stdinOf(client); ok && len(d) == 0 {
+		client.WriteBytes(stdin)
+		client.Flush()
+	} else if len(d) > 0 {
+		fileNames := make([]string, len(d))
+		for i, arg := range d {
+			fileNames[i] = string(arg)
+		}
+		fileNames, err := t.expandArgs(client, "cat", fileNames)
 		if err != nil {
-			client.WriteError(err)
-		} else {
-			client.WriteBytes(content)
+			t.writeError(client, err)
+			return nil
 		}
-		client.Flush()
-	} else {
-		client.WriteError(errors.New("cat takes at least 1 parameter (cat filename)"))
-		client.Flush()
-	}
-
-	return nil
-}
-
-func (t *TermBackend) ListFiles(data interface{}, client server.ProtocolClient) error {
-	files, err := ioutil.ReadDir(t.homeDir)
 
-	filenames := []interface{}{}
-	if err != nil {
-		client.WriteError(err)
-		client.Flush()
-	} else {
-		for _, f := range files {
-			if !f.IsDir() {
-				filenames = append(filenames, f.Name())
+		contents := []byte{}
+		errs := PathErrors{}
+		for _, fileName := range fileNames {
+			fullPath, err := t.resolve(client, "cat", fileName)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			content, err := ioutil.ReadFile(fullPath)
+			if err != nil {
+				errs = append(errs, newPathError("cat", fileName, err))
+				continue
 			}
+			contents = append(contents, content...)
 		}
-		client.WriteArray(filenames)
+		if len(errs) > 0 {
+			t.writeError(client, errs)
+			return nil
+		}
+		client.WriteBytes(contents)
 		client.Flush()
+	} else {
+		t.writeError(client, errors.New("cat takes at least 1 parameter (cat filename...)"))
 	}
+
 	return nil
 }
 
@@ -65,17 +144,33 @@ func (t *TermBackend) EditFile(data interface{}, client server.ProtocolClient) e
 	d, _ := data.([][]byte)
 	if len(d) > 0 {
 		fileName := string(d[0])
-		content, err := ioutil.ReadFile(path.Join(t.homeDir, fileName))
+		fullPath, err := t.resolve(client, "edit", fileName)
+		if err != nil {
+			t.writeError(client, err)
+			return nil
+		}
+		fileMap := make(map[string]string)
+		fileMap["filename"] = glob.Unescape(fileName)
+		fileMap["contents"] = ""
+		fileMap["version"] = missingVersion
+
+		info, err := os.Stat(fullPath)
 		if err == nil {
-			fileMap := make(map[string]string)
-			fileMap["filename"] = fileName
-			fileMap["contents"] = string(content)
-			client.WriteJson(fileMap)
-			client.Flush()
+			var content []byte
+			content, err = ioutil.ReadFile(fullPath)
+			if err == nil {
+				fileMap["contents"] = string(content)
+				if !utf8.Valid(content) {
+					// json would mangle the invalid bytes, send them as base64 instead
+					fileMap["contents"] = base64.StdEncoding.EncodeToString(content)
+					fileMap["encoding"] = "base64"
+				}
+				fileMap["version"] = fileVersion(info, content)
+			}
+		}
+		if err != nil && !os.IsNotExist(err) {
+			t.writeError(client, newPathError("edit", fileName, err))
 		} else {
-			fileMap := make(map[string]string)
-			fileMap["filename"] = fileName
-			fileMap["contents"] = ""
 			client.WriteJson(fileMap)
 			client.Flush()
 		}
@@ -86,41 +181,248 @@ func (t *TermBackend) EditFile(data interface{}, client server.ProtocolClient) e
 
 func (t *TermBackend) SaveFile(data interface{}, client server.ProtocolClient) error {
 	d, _ := data.([][]byte)
+	force := false
+	for len(d) > 0 && string(d[0]) == "--force" {
+		force = true
+		d = d[1:]
+	}
+	if stdin, ok := stdinOf(client); ok && len(d) == 1 {
+		// save filename reading the contents from a pipeline
+		d = append(d, stdin)
+	}
 	if len(d) >= 2 {
+		// only the file name is escaped, the contents are written as they were sent
 		fileName := string(d[0])
 		content := d[1]
-		err := ioutil.WriteFile(fileName, content, 0644)
+		fullPath, err := t.resolve(client, "save", fileName)
 		if err != nil {
-			client.WriteError(err)
-			client.Flush()
-		} else {
-			client.WriteString("saved " + fileName + " successfully")
-			client.Flush()
+			t.writeError(client, err)
+			return nil
 		}
-	} else {
-		client.WriteError(errors.New("save takes at least 2 parameters (save filename filecontents...)"))
+
+		// saves are serialized so that the version check and write happen together
+		t.saveLock.Lock()
+		defer t.saveLock.Unlock()
+
+		if len(d) >= 3 && !force {
+			version, err := currentVersion(fullPath)
+			if err != nil {
+				t.writeError(client, newPathError("save", fileName, err))
+				return nil
+			}
+			if version != string(d[2]) {
+				t.writeError(client, &PathError{"save", fileName, ErrConflict})
+				return nil
+			}
+		}
+
+		err = t.storeFile(fullPath, content)
+		if err != nil {
+			t.writeError(client, newPathError("save", fileName, err))
+			return nil
+		}
+		version, err := currentVersion(fullPath)
+		if err != nil {
+			t.writeError(client, newPathError("save", fileName, err))
+			return nil
+		}
+
+		fileMap := make(map[string]string)
+		fileMap["filename"] = glob.Unescape(fileName)
+		fileMap["version"] = version
+		fileMap["message"] = "saved " + fileName + " successfully"
+		client.WriteJson(fileMap)
 		client.Flush()
+	} else {
+		t.writeError(client, errors.New("save takes at least 2 parameters (save [--force] filename filecontents [version])"))
 	}
 
 	return nil
 }
 
-func RegisterTermBackend(app *server.BroadcastServer, homeDir string) (server.Backend, error) {
+func (t *TermBackend) ChangeDir(data interface{}, client server.ProtocolClient) error {
+	d, _ := data.([][]byte)
+	session := t.sessions.Get(client)
+	dir := "/"
+	if len(d) > 0 {
+		dir = string(d[0])
+	}
+	if dir == "-" {
+		session.Lock()
+		dir = session.oldCwd
+		session.Unlock()
+	}
+
+	cwd, err := t.lookupDir(client, "cd", dir)
+	if err != nil {
+		t.writeError(client, err)
+		return nil
+	}
+	session.Chdir(cwd)
+	client.WriteString(cwd)
+	client.Flush()
+	return nil
+}
+
+func (t *TermBackend) PrintDir(data interface{}, client server.ProtocolClient) error {
+	client.WriteString(t.sessions.Get(client).Cwd())
+	client.Flush()
+	return nil
+}
+
+func (t *TermBackend) PushDir(data interface{}, client server.ProtocolClient) error {
+	d, _ := data.([][]byte)
+	session := t.sessions.Get(client)
+	if len(d) == 0 {
+		// swap the working directory with the top of the stack
+		session.Lock()
+		if len(session.dirStack) == 0 {
+			session.Unlock()
+			t.writeError(client, errors.New("pushd: no other directory"))
+			return nil
+		}
+		top := len(session.dirStack) - 1
+		session.cwd, session.dirStack[top] = session.dirStack[top], session.cwd
+		session.Unlock()
+	} else {
+		cwd, err := t.lookupDir(client, "pushd", string(d[0]))
+		if err != nil {
+			t.writeError(client, err)
+			return nil
+		}
+		session.Lock()
+		session.dirStack = append(session.dirStack, session.cwd)
+		session.Unlock()
+		session.Chdir(cwd)
+	}
+
+	return t.ListDirs(nil, client)
+}
+
+func (t *TermBackend) PopDir(data interface{}, client server.ProtocolClient) error {
+	session := t.sessions.Get(client)
+	session.Lock()
+	if len(session.dirStack) == 0 {
+		session.Unlock()
+		t.writeError(client, errors.New("popd: directory stack empty"))
+		return nil
+	}
+	top := len(session.dirStack) - 1
+	dir := session.dirStack[top]
+	session.dirStack = session.dirStack[:top]
+	session.Unlock()
+	session.Chdir(dir)
+
+	return t.ListDirs(nil, client)
+}
+
+func (t *TermBackend) ListDirs(data interface{}, client server.ProtocolClient) error {
+	dirs := []interface{}{}
+	for _, dir := range t.sessions.Get(client).Dirs() {
+		dirs = append(dirs, dir)
+	}
+	client.WriteArray(dirs)
+	client.Flush()
+	return nil
+}
+
+// lookupDir resolves the given directory for the client, returning it as a sandbox relative path
+func (t *TermBackend) lookupDir(client server.ProtocolClient, op, dir string) (string, error) {
+	fullPath, err := t.resolve(client, op, dir)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return "", newPathError(op, dir, err)
+	}
+	if !info.IsDir() {
+		return "", &PathError{op, dir, errors.New("not a directory")}
+	}
+	return t.sandbox.Rel(fullPath), nil
+}
+
+func RegisterTermBackend(app *server.BroadcastServer, cfg *TermConfig) (server.Backend, error) {
 	backend := new(TermBackend)
 	backend.app = app
+	backend.commands = make(map[string]func(interface{}, server.ProtocolClient) error)
+	backend.help = make(map[string]server.Command)
+	backend.policy = cfg.Policy
+	backend.audit = cfg.Audit
+	backend.sessions = cfg.Sessions
+	if backend.sessions == nil {
+		backend.sessions = NewSessionStore()
+	}
 
-	// locate the resume content from the home directory
+	registry := cfg.Metrics
+	if registry == nil {
+		registry = metrics.NewRegistry()
+	}
+	backend.metrics = NewCommandMetrics(registry, cfg.Clients)
+
+	identify := server.Command{"identify", "Runs the commands of this connection as the given user", identifyUsage, false}
+	backend.help["IDENTIFY"] = identify
+	app.RegisterCommand(identify, backend.measured("identify", backend.audited("identify", backend.Identify)))
+	more := server.Command{"more", "Reads the next batch of a streamed reply (grep, find)", "", true}
+	backend.help["MORE"] = more
+	app.RegisterCommand(more, backend.More)
+	session := server.Command{"session", "Starts the directories of this connection over or continues those kept under key", sessionUsage, false}
+	backend.help["SESSION"] = session
+	app.RegisterCommand(session, backend.measured("session", backend.audited("session", backend.Session)))
+	backend.registerCommand(server.Command{"audit", "Shows the most recent commands of the audit log", auditUsage, false}, backend.Audit)
+	backend.registerCommand(server.Command{"metrics", "Shows the calls, errors, latency and sizes of every command", metricsUsage, false}, backend.Metrics)
+	if cfg.DefaultCommands {
+		backend.registerDefaults()
+	}
+	if !cfg.FileCommands {
+		return backend, nil
+	}
+
+	homeDir := cfg.HomeDir
 	if homeDir == "" {
 		usr, _ := user.Current()
 		homeDir = usr.HomeDir
 	}
-	backend.homeDir = homeDir
+	sandbox, err := NewSandbox(homeDir, cfg.Sandbox)
+	if err != nil {
+		return nil, err
+	}
+	backend.homeDir = sandbox.Root()
+	backend.sandbox = sandbox
+	backend.history = NewHistory(sandbox, cfg.HistoryLimit)
+
+	// locate the resume content from the home directory
+	if cfg.ResumeFile != "" && cfg.ResumeCmd != "" {
+		resumePath, err := sandbox.Resolve(cfg.ResumeCmd, cfg.ResumeFile)
+		if err != nil {
+			return nil, err
+		}
+		backend.resume = &Resume{fullPath: resumePath}
+		backend.resume.Text()
+		backend.registerCommand(server.Command{cfg.ResumeCmd, "Shows the greeting from " + cfg.ResumeFile, "", false}, backend.ShowResume)
+	}
 
-	app.RegisterCommand(server.Command{"cat", "Concatenate the contents of a file", "", false}, backend.CatFile)
-	app.RegisterCommand(server.Command{"ls", "Lists the files in the directory", "", false}, backend.ListFiles)
-	app.RegisterCommand(server.Command{"dir", "Lists the files in the directory", "", false}, backend.ListFiles)
-	app.RegisterCommand(server.Command{"edit", "Edit the contents of a file", "", false}, backend.EditFile)
-	app.RegisterCommand(server.Command{"save", "Saves the contents of a file", "", false}, backend.SaveFile)
+	backend.registerCommand(server.Command{"sh", "Runs a pipeline of commands with redirections", shUsage, false}, backend.Shell)
+	backend.registerCommand(server.Command{"cat", "Concatenate the contents of a file", "cat filename...", false}, backend.CatFile)
+	backend.registerCommand(server.Command{"ls", "Lists the files in the directory", lsUsage, false}, backend.ListFiles)
+	backend.registerCommand(server.Command{"dir", "Lists the files in the directory", lsUsage, false}, backend.ListFiles)
+	backend.registerCommand(server.Command{"edit", "Edit the contents of a file", "edit filename", false}, backend.EditFile)
+	backend.registerCommand(server.Command{"save", "Saves the contents of a file", "save [--force] filename filecontents [version]", false}, backend.SaveFile)
+	backend.registerCommand(server.Command{"history", "Lists the saved revisions of a file", "history filename", false}, backend.ShowHistory)
+	backend.registerCommand(server.Command{"show", "Shows the contents of a file revision", "show filename@rev", false}, backend.ShowRevision)
+	backend.registerCommand(server.Command{"revert", "Reverts a file to a saved revision", "revert filename rev", false}, backend.RevertFile)
+	backend.registerCommand(server.Command{"grep", "Searches files for lines matching a pattern", grepUsage, false}, backend.Grep)
+	backend.registerCommand(server.Command{"find", "Finds files in the directory hierarchy", findUsage, false}, backend.Find)
+	backend.registerCommand(server.Command{"mkdir", "Creates directories", "mkdir [-p] dir...", false}, backend.MakeDir)
+	backend.registerCommand(server.Command{"rm", "Removes files or directories", "rm [-r] file...", false}, backend.RemoveFile)
+	backend.registerCommand(server.Command{"mv", "Moves or renames files", "mv source... dest", false}, backend.MoveFile)
+	backend.registerCommand(server.Command{"cp", "Copies files or directories", "cp [-r] source... dest", false}, backend.CopyFile)
+	backend.registerCommand(server.Command{"touch", "Creates files or updates their modification time", "touch file...", false}, backend.TouchFile)
+	backend.registerCommand(server.Command{"cd", "Changes the current working directory", "cd [dir|-]", false}, backend.ChangeDir)
+	backend.registerCommand(server.Command{"pwd", "Prints the current working directory", "", false}, backend.PrintDir)
+	backend.registerCommand(server.Command{"pushd", "Saves the current directory and changes to the given one", "pushd [dir]", false}, backend.PushDir)
+	backend.registerCommand(server.Command{"popd", "Changes to the directory on top of the directory stack", "", false}, backend.PopDir)
+	backend.registerCommand(server.Command{"dirs", "Lists the directory stack", "", false}, backend.ListDirs)
 	return backend, nil
 }
 
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// missingVersion is the version token of a file that does not exist yet
+const missingVersion = "0"
+
+// ErrConflict is returned when a file changed since the version a client is saving against
+var ErrConflict = errors.New("conflict, the file has changed since it was opened (use save --force to overwrite)")
+
+// fileVersion returns the version token of a file with the given info and
+// contents, the token changes whenever the mtime, size or contents change
+func fileVersion(info os.FileInfo, content []byte) string {
+	sum := sha1.Sum(content)
+	return strconv.FormatInt(info.ModTime().UnixNano(), 36) + "-" +
+		strconv.FormatInt(info.Size(), 36) + "-" +
+		hex.EncodeToString(sum[:8])
+}
+
+// currentVersion returns the version token of the file at fullPath as it is on disk
+func currentVersion(fullPath string) (string, error) {
+	info, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		return missingVersion, nil
+	} else if err != nil {
+		return "", err
+	}
+	content, err := ioutil.ReadFile(fullPath)
+	if err != nil {
+		return "", err
+	}
+	return fileVersion(info, content), nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// isAuditTail reports whether the reply holds the records of audit tail
+func isAuditTail(reply interface{}) bool {
+	r, ok := reply.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, ok = r["records"].([]interface{})
+	return ok
+}
+
+func printAuditTail(reply map[string]interface{}) {
+	records, _ := reply["records"].([]interface{})
+	for _, r := range records {
+		rec, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		user, _ := rec["user"].(string)
+		if user == "" {
+			user = "-"
+		}
+		line := fmt.Sprintf("%v %v %s %v %v", rec["time"], rec["source"], user, rec["remote_addr"], rec["cmd"])
+		args, _ := rec["args"].([]interface{})
+		for _, arg := range args {
+			line += " " + strconv.Quote(fmt.Sprint(arg))
+		}
+		duration, _ := rec["duration_ms"].(float64)
+		line += fmt.Sprintf(" -> %v (%.1fms)", rec["status"], duration)
+		if msg, ok := rec["error"].(string); ok {
+			line += ": " + msg
+		}
+		fmt.Printf("%s\n", line)
+	}
+}
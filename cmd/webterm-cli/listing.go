@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// terminalWidth is the width used to lay out short listings in columns
+const terminalWidth = 80
+
+// isListing reports whether the reply is a structured ls listing
+func isListing(reply interface{}) bool {
+	r, ok := reply.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, ok = r["listings"].([]interface{})
+	return ok
+}
+
+func printListing(reply map[string]interface{}) {
+	long, _ := reply["long"].(bool)
+	human, _ := reply["human"].(bool)
+	listings, _ := reply["listings"].([]interface{})
+	for i, l := range listings {
+		listing, ok := l.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		p, _ := listing["path"].(string)
+		if msg, ok := listing["error"].(string); ok {
+			fmt.Printf("%s\n", msg)
+			continue
+		}
+		if len(listings) > 1 && p != "" {
+			if i > 0 {
+				fmt.Printf("\n")
+			}
+			fmt.Printf("%s:\n", p)
+		}
+
+		entries, _ := listing["entries"].([]interface{})
+		rows := [][]string{}
+		for _, e := range entries {
+			if entry, ok := e.(map[string]interface{}); ok {
+				rows = append(rows, listingRow(entry, human))
+			}
+		}
+		if long {
+			printLongListing(rows)
+		} else {
+			printShortListing(rows)
+		}
+	}
+	if truncated, _ := reply["truncated"].(bool); truncated {
+		fmt.Printf("(listing truncated)\n")
+	}
+}
+
+// listingRow returns the mode, size, mtime and name columns of an entry
+func listingRow(entry map[string]interface{}, human bool) []string {
+	mode, _ := entry["mode"].(string)
+	name, _ := entry["name"].(string)
+	size, _ := entry["size"].(float64)
+	if t, _ := entry["type"].(string); t == "dir" {
+		name += "/"
+	}
+	if target, ok := entry["target"].(string); ok && target != "" {
+		name += " -> " + target
+	}
+
+	mtime, _ := entry["mtime"].(string)
+	if t, err := time.Parse(time.RFC3339, mtime); err == nil {
+		mtime = t.Local().Format("Jan _2 15:04")
+	}
+
+	sizeText := fmt.Sprintf("%d", int64(size))
+	if human {
+		sizeText = humanSize(int64(size))
+	}
+	return []string{mode, sizeText, mtime, name}
+}
+
+func printLongListing(rows [][]string) {
+	widths := make([]int, 3)
+	for _, row := range rows {
+		for i := range widths {
+			if len(row[i]) > widths[i] {
+				widths[i] = len(row[i])
+			}
+		}
+	}
+	for _, row := range rows {
+		fmt.Printf("%-*s %*s %-*s %s\n", widths[0], row[0], widths[1], row[1], widths[2], row[2], row[3])
+	}
+}
+
+func printShortListing(rows [][]string) {
+	if len(rows) == 0 {
+		return
+	}
+	width := 0
+	for _, row := range rows {
+		if len(row[3]) > width {
+			width = len(row[3])
+		}
+	}
+	width += 2
+
+	cols := terminalWidth / width
+	if cols < 1 {
+		cols = 1
+	}
+	lines := (len(rows) + cols - 1) / cols
+	for l := 0; l < lines; l++ {
+		line := ""
+		for c := 0; c < cols; c++ {
+			i := c*lines + l
+			if i < len(rows) {
+				line += fmt.Sprintf("%-*s", width, rows[i][3])
+			}
+		}
+		fmt.Printf("%s\n", strings.TrimRight(line, " "))
+	}
+}
+
+// humanSize formats a size in bytes using powers of 1024 (1.5K, 12M...)
+func humanSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d", size)
+	}
+	value := float64(size)
+	units := "KMGTPE"
+	i := -1
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if value < 10 {
+		return fmt.Sprintf("%.1f%c", value, units[i])
+	}
+	return fmt.Sprintf("%.0f%c", value, units[i])
+}
@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/nyxtom/broadcast/client/go/broadcast"
+	"github.com/nyxtom/webterm/glob"
 )
 
 var helpCommands = [][]string{}
@@ -44,7 +45,7 @@ func main() {
 	prompt := ""
 
 	for {
-		prompt = fmt.Sprintf("%s> ", addr)
+		prompt = fmt.Sprintf("%s:%s> ", addr, currentDir(c))
 
 		cmd, err := line(prompt)
 		if err != nil {
@@ -55,12 +56,21 @@ func main() {
 		cmds := reg.FindAllString(cmd, -1)
 		if len(cmds) == 0 {
 			continue
+		} else if glob.NeedsShell(cmd) {
+			// pipelines and redirections are evaluated by the server
+			addHistory(cmd)
+			printReplies(c, "SH", cmd)
+			fmt.Printf("\n")
 		} else {
 			addHistory(cmd)
 
 			args := make([]interface{}, len(cmds[1:]))
 			for i := range args {
 				item := strings.Trim(string(cmds[1+i]), "\"'")
+				if item != cmds[1+i] {
+					// quoted arguments are never glob expanded by the server
+					item = glob.Escape(item)
+				}
 				if a, err := strconv.Atoi(item); err == nil {
 					args[i] = a
 				} else if a, err := strconv.ParseFloat(item, 64); err == nil {
@@ -76,6 +86,12 @@ func main() {
 			}
 
 			cmd := strings.ToUpper(cmds[0])
+			if i := glob.ContentArg(cmd, stringArgs(args)); i >= 0 {
+				// file contents are saved as they were typed
+				if item, ok := args[i].(string); ok {
+					args[i] = glob.Unescape(item)
+				}
+			}
 			if strings.ToLower(cmd) == "help" || cmd == "?" {
 				printHelp(cmds)
 			} else if cmd == "CMDS" {
@@ -85,12 +101,7 @@ func main() {
 				if async {
 					c.DoAsync(cmd, args...)
 				} else {
-					reply, err := c.Do(cmd, args...)
-					if err != nil {
-						fmt.Printf("%s", err.Error())
-					} else {
-						printReply(cmd, reply, "")
-					}
+					printReplies(c, cmd, args...)
 				}
 				fmt.Printf("\n")
 			}
@@ -98,6 +109,36 @@ func main() {
 	}
 }
 
+// printReplies sends the command and prints its reply, the batches of streamed
+// replies (grep and find write one per batch, all but the last with more set)
+// are printed as they arrive, the next one is read by sending MORE
+func printReplies(c *broadcast.Client, cmd string, args ...interface{}) {
+	reply, err := c.Do(cmd, args...)
+	for err == nil {
+		printReply(cmd, reply, "")
+		if r, ok := reply.(map[string]interface{}); !ok || r["more"] != true {
+			return
+		}
+		reply, err = c.Do("MORE")
+	}
+	fmt.Printf("%s", err.Error())
+}
+
+// currentDir asks the server for the working directory of our session
+func currentDir(c *broadcast.Client) string {
+	reply, err := c.Do("PWD")
+	if err != nil {
+		return "?"
+	}
+	switch reply := reply.(type) {
+	case string:
+		return reply
+	case []byte:
+		return string(reply)
+	}
+	return "?"
+}
+
 func isCmdAsync(cmd string) bool {
 	for _, v := range helpCommands {
 		if v[0] == cmd && v[3] == "true" {
@@ -133,6 +174,22 @@ func printReply(cmd string, reply interface{}, indent string) {
 		}
 		return
 	}
+	if isListing(reply) {
+		printListing(reply.(map[string]interface{}))
+		return
+	}
+	if isSearchResult(reply) {
+		printSearchResult(reply.(map[string]interface{}))
+		return
+	}
+	if isAuditTail(reply) {
+		printAuditTail(reply.(map[string]interface{}))
+		return
+	}
+	if isCommandStats(reply) {
+		printCommandStats(reply.(map[string]interface{}))
+		return
+	}
 	switch reply := reply.(type) {
 	case int64:
 		fmt.Printf("(integer) %d\n", reply)
@@ -238,3 +295,12 @@ func completionHandler(in string) []string {
 	}
 	return keywords
 }
+
+// stringArgs returns the string arguments, others are left empty
+func stringArgs(args []interface{}) []string {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i], _ = arg.(string)
+	}
+	return strs
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// isCommandStats reports whether the reply holds the command metrics
+func isCommandStats(reply interface{}) bool {
+	r, ok := reply.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, ok = r["commands"].([]interface{})
+	return ok
+}
+
+func printCommandStats(reply map[string]interface{}) {
+	commands, _ := reply["commands"].([]interface{})
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "cmd\tcalls\terrors\tavg ms\tp99 ms\tbytes in\tbytes out\t\n")
+	for _, c := range commands {
+		cmd, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		avg, _ := cmd["avg_ms"].(float64)
+		p99 := "-"
+		if ms, ok := cmd["p99_ms"].(float64); ok {
+			p99 = fmt.Sprintf("%.1f", ms)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%.1f\t%s\t%v\t%v\t\n", cmd["cmd"], cmd["calls"], cmd["errors"], avg, p99, cmd["bytes_in"], cmd["bytes_out"])
+	}
+	w.Flush()
+	uptime, _ := reply["uptime_seconds"].(float64)
+	fmt.Printf("%v clients, up %.0fs\n", reply["clients"], uptime)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+)
+
+// isSearchResult reports whether the reply is a structured grep or find result
+func isSearchResult(reply interface{}) bool {
+	r, ok := reply.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, grep := r["matches"].([]interface{})
+	_, find := r["found"].([]interface{})
+	return grep || find
+}
+
+func printSearchResult(reply map[string]interface{}) {
+	if files, ok := reply["files"].([]interface{}); ok {
+		for _, f := range files {
+			fmt.Printf("%v\n", f)
+		}
+	}
+
+	numbers, _ := reply["numbers"].(bool)
+	matches, _ := reply["matches"].([]interface{})
+	for i, m := range matches {
+		match, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		file, _ := match["file"].(string)
+		line, _ := match["line"].(float64)
+		before, _ := match["before"].([]interface{})
+		after, _ := match["after"].([]interface{})
+		if i > 0 && (len(before) > 0 || len(after) > 0) {
+			fmt.Printf("--\n")
+		}
+		printGrepLine(file, int(line)-len(before), before, numbers, "-")
+		printGrepLine(file, int(line), []interface{}{match["text"]}, numbers, ":")
+		printGrepLine(file, int(line)+1, after, numbers, "-")
+	}
+
+	found, _ := reply["found"].([]interface{})
+	for _, f := range found {
+		if entry, ok := f.(map[string]interface{}); ok {
+			fmt.Printf("%v\n", entry["name"])
+		}
+	}
+
+	if truncated, _ := reply["truncated"].(bool); truncated {
+		fmt.Printf("(results truncated)\n")
+	}
+}
+
+// printGrepLine prints lines the way grep does, sep is ":" for matches and "-" for context
+func printGrepLine(file string, line int, texts []interface{}, numbers bool, sep string) {
+	for i, text := range texts {
+		prefix := ""
+		if file != "" {
+			prefix = file + sep
+		}
+		if numbers {
+			prefix += fmt.Sprintf("%d%s", line+i, sep)
+		}
+		fmt.Printf("%s%v\n", prefix, text)
+	}
+}
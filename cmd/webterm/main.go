@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nyxtom/webterm"
+	"github.com/nyxtom/workclient"
+)
+
+func attachWebFlags() func() *webterm.WebConfig {
+	// standard configurations (statsd, http endpoint, reconnection timeout)
+	var statsdAddr = flag.String("statsd_addr", "", "address to statsd for publishing statistics about the stream")
+	var statsdInterval = flag.Int("statsd_interval", 2, "flush interval for the statsd client to the endpoint in seconds")
+	var statsdPrefix = flag.String("statsd_prefix", "", "statsd prefix for the webterm")
+
+	var graphiteAddr = flag.String("graphite_addr", "", "graphite address for the webterm metrics")
+	var graphitePrefix = flag.String("graphite_prefix", "", "graphite prefix for the webterm")
+
+	var stdErrLog = flag.String("stderr_logfile", "", "writes all stderr log output to the given file or endpoint")
+
+	var serviceName = flag.String("service_name", "webterm", "name of the service that this configuration is running")
+	var hostname = flag.String("hostname", "", "resolved hostname of the service should the OS level hostname be unavailable")
+
+	// etcd configuration endpoint for service registry
+	var etcdAddr = flag.String("etcd_addr", "", "host address for etcd for service registration")
+	var etcdCaCert = flag.String("etcd_cacert", "", "cacert for tls client associated with etcd connections")
+	var etcdTlsKey = flag.String("etcd_tlskey", "", "tlskey associated with clients connected to etcd")
+	var etcdTlsCert = flag.String("etcd_tlscert", "", "tlscert associated with clients connected to etcd")
+	var etcdPrefixKey = flag.String("etcd_prefix_key", "", "etcd prefix key associated with the registered services")
+	var etcdHeartbeatTtl = flag.Int("etcd_heartbeat_ttl", 3, "time in seconds between heartbeat service checks")
+
+	// web configuration values
+	var webAddr = flag.String("web_addr", ":5000", "primary web address location to listen on")
+	var readTimeout = flag.Duration("web_read_timeout", 10*time.Second, "read connection timeout for the web host")
+	var writeTimeout = flag.Duration("web_write_timeout", 10*time.Second, "write connection timeout for the web host")
+	var maxHeaderBytes = flag.Int("web_max_header_bytes", 1<<16, "maximum header bytes for the web host")
+	var basePath = flag.String("base_path", "", "path the terminal is served under, such as /term (empty for the root)")
+	var tlsCert = flag.String("web_tls_cert", "", "certificate file to serve https with (reloaded on SIGHUP)")
+	var tlsKey = flag.String("web_tls_key", "", "private key file of the https certificate")
+	var tlsClientCA = flag.String("web_tls_client_ca", "", "ca file that client certificates must be signed by, enables mutual tls")
+	var tlsClientAuth = flag.String("web_tls_client_auth", "require", "whether client certificates are required or optional when web_tls_client_ca is set")
+	var redirectAddr = flag.String("web_redirect_addr", "", "address to listen on for plain http requests and redirect them to https (requires web_tls_cert)")
+
+	// broadcast client configuration
+	var bPort = flag.Int("broadcast_port", 7337, "primary broadcast server location port")
+	var bIP = flag.String("broadcast_ip", "127.0.0.1", "primary broadcast server location host")
+	var bProtocol = flag.String("broadcast_proto", "redis", "primary broadcast server protocol")
+	var bMaxIdle = flag.Int("broadcast_max_idle", 8, "maximum number of idle connections kept to the broadcast server")
+	var bMaxActive = flag.Int("broadcast_max_active", 64, "maximum number of connections in use to the broadcast server, 0 for no limit")
+	var bDialTimeout = flag.Duration("broadcast_dial_timeout", 5*time.Second, "time allowed to connect to (or wait for a free connection to) the broadcast server")
+	var bIdleTimeout = flag.Duration("broadcast_idle_timeout", 5*time.Minute, "idle connections to the broadcast server are closed after this long")
+	var greetingCmd = flag.String("greeting_cmd", "resume", "broadcast command whose reply is shown as the terminal greeting")
+	var assetsDir = flag.String("assets_dir", "", "serve the web ui from this directory instead of the copy built into the binary (for development)")
+
+	// authentication configuration
+	var usersFile = flag.String("users_file", "", "toml file of the user accounts allowed to log in (logins are disabled without one)")
+	var sessionSecret = flag.String("session_secret", "", "key used to sign session cookies, random on every start when empty")
+	var sessionTTL = flag.Duration("session_ttl", 12*time.Hour, "time a login stays valid for")
+
+	// audit log configuration
+	var auditFile = flag.String("audit_file", "", "append-only audit log of every command run from a browser (json lines)")
+	var auditMaxSize = flag.Int64("audit_max_size", 10<<20, "size in bytes at which the audit log is rotated")
+	var auditMaxBackups = flag.Int("audit_max_backups", 5, "number of rotated audit logs kept")
+
+	// access log configuration
+	var accessLogFormat = flag.String("access_log_format", "combined", "format of the access log, combined, json or off")
+	var accessLogFile = flag.String("access_log_file", "", "file the access log is appended to, the regular log when empty")
+	var metrics = flag.Bool("metrics", true, "serve prometheus metrics at /metrics")
+
+	// configuration file option
+	var configFile = flag.String("config", "", "configuration file to load as an alternative to explicit flags (toml formatted), the [policy] is only read from here")
+	return func() *webterm.WebConfig {
+		cfg := &webterm.WebConfig{
+			Config: workclient.Config{*statsdAddr, *statsdInterval, *statsdPrefix,
+				*stdErrLog, *graphiteAddr, *graphitePrefix,
+				*etcdAddr, *etcdCaCert, *etcdTlsKey, *etcdTlsCert, *etcdPrefixKey, *etcdHeartbeatTtl,
+				*serviceName, *hostname, *webAddr, *readTimeout, *writeTimeout, *maxHeaderBytes},
+			WebTLSCert:       *tlsCert,
+			WebTLSKey:        *tlsKey,
+			WebTLSClientCA:   *tlsClientCA,
+			WebTLSClientAuth: *tlsClientAuth,
+			WebRedirectAddr:  *redirectAddr,
+			HandlerConfig: webterm.HandlerConfig{
+				BasePath:             *basePath,
+				BroadcastPort:        *bPort,
+				BroadcastIP:          *bIP,
+				BroadcastProto:       *bProtocol,
+				BroadcastMaxIdle:     *bMaxIdle,
+				BroadcastMaxActive:   *bMaxActive,
+				BroadcastDialTimeout: *bDialTimeout,
+				BroadcastIdleTimeout: *bIdleTimeout,
+				GreetingCmd:          *greetingCmd,
+				AssetsDir:            *assetsDir,
+				UsersFile:            *usersFile,
+				SessionSecret:        *sessionSecret,
+				SessionTTL:           *sessionTTL,
+				AuditFile:            *auditFile,
+				AuditMaxSize:         *auditMaxSize,
+				AuditMaxBackups:      *auditMaxBackups,
+				AccessLogFormat:      *accessLogFormat,
+				AccessLogFile:        *accessLogFile,
+				Metrics:              *metrics,
+			},
+		}
+
+		// load configuration file data from toml format appropriately
+		return loadConfig(cfg, *configFile)
+	}
+}
+
+func loadConfig(cfg *webterm.WebConfig, configFile string) *webterm.WebConfig {
+	if configFile != "" {
+		data, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			panic(err)
+		}
+
+		_, err = toml.Decode(string(data), cfg)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return cfg
+}
+
+func main() {
+	var fd = flag.Int("fd", 0, "existing listening socket file descriptor")
+	var background = flag.Bool("background", false, "run the process in the background")
+	var hashPassword = flag.Bool("hash_password", false, "reads a password from stdin and prints its hash for the users file")
+	appConfigFn := attachWebFlags()
+	flag.Parse()
+
+	if *hashPassword {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatal(err)
+		}
+		hash, err := webterm.HashPassword(strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(hash)
+	} else if *background {
+		args := []string{}
+		for _, k := range os.Args {
+			if k != "--background" && k != "-background" {
+				args = append(args, k)
+			}
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err := cmd.Start()
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if err := webterm.ServeWeb(appConfigFn(), *fd, os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
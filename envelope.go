@@ -0,0 +1,146 @@
+package webterm
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commandsRefresh is the least time between reloading the list of commands
+// known to the broadcast server when an unknown command is seen
+const commandsRefresh = 30 * time.Second
+
+// ExecError describes why a command could not be run
+type ExecError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	status  int
+}
+
+func (e *ExecError) Error() string {
+	return e.Message
+}
+
+func newExecError(status int, code, message string) *ExecError {
+	return &ExecError{code, message, status}
+}
+
+// errBadRequest is returned for malformed requests or arguments
+func errBadRequest(message string) *ExecError {
+	return newExecError(http.StatusBadRequest, "bad_request", message)
+}
+
+// errCommandFailed is returned when the command itself replied with an error
+func errCommandFailed(message string) *ExecError {
+	return newExecError(http.StatusBadRequest, "command_failed", message)
+}
+
+// errForbidden is returned when the policy does not allow the command for the user
+func errForbidden(message string) *ExecError {
+	return newExecError(http.StatusForbidden, "forbidden", message)
+}
+
+// errUnknownCommand is returned for commands the broadcast server does not know about
+func errUnknownCommand(cmd string) *ExecError {
+	return newExecError(http.StatusNotFound, "unknown_command", "unknown command "+strings.ToLower(cmd))
+}
+
+// errUnavailable maps errors reaching the broadcast server to a gateway error,
+// a pool that is full or shut down is unavailable rather than broken
+func errUnavailable(err error) *ExecError {
+	if err == ErrPoolExhausted || err == ErrPoolClosed {
+		return newExecError(http.StatusServiceUnavailable, "unavailable", err.Error())
+	}
+	return newExecError(http.StatusBadGateway, "backend_error", "broadcast server unavailable: "+err.Error())
+}
+
+// execResponse is the envelope of every reply to a command
+type execResponse struct {
+	OK         bool          `json:"ok"`
+	Cmd        string        `json:"cmd,omitempty"`
+	Args       []interface{} `json:"args,omitempty"`
+	Reply      interface{}   `json:"reply,omitempty"`
+	Cwd        string        `json:"cwd,omitempty"`
+	Error      *ExecError    `json:"error,omitempty"`
+	DurationMs float64       `json:"duration_ms"`
+
+	start time.Time
+}
+
+func newExecResponse(cmd string, args []interface{}) *execResponse {
+	return &execResponse{OK: true, Cmd: cmd, Args: args, start: time.Now()}
+}
+
+// fail marks the response as failed with the given error
+func (resp *execResponse) fail(err *ExecError) *execResponse {
+	resp.OK = false
+	resp.Error = err
+	resp.Reply = nil
+	return resp
+}
+
+// status returns the http status code matching the response
+func (resp *execResponse) status() int {
+	if resp.Error != nil {
+		return resp.Error.status
+	}
+	return http.StatusOK
+}
+
+// writeResponse writes the envelope as json with the matching status code
+func (handler *Handler) writeResponse(w http.ResponseWriter, resp *execResponse) {
+	resp.DurationMs = float64(time.Since(resp.start)) / float64(time.Millisecond)
+	js, err := json.Marshal(resp)
+	if err != nil {
+		handler.LogErr(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.status())
+	w.Write(js)
+}
+
+// commandSet caches the names of the commands known to the broadcast server
+type commandSet struct {
+	sync.Mutex
+
+	names    map[string]bool
+	loadedAt time.Time
+}
+
+// known reports whether cmd is a command of the broadcast server, the list of
+// commands is reloaded (at most every commandsRefresh) when cmd is not in it
+// so that backends loaded later are picked up. Fire and forget commands (such
+// as more) never reply and are left out, a connection would wait forever.
+func (set *commandSet) known(c Conn, cmd string) (bool, error) {
+	set.Lock()
+	defer set.Unlock()
+	if set.names[cmd] {
+		return true, nil
+	}
+	if set.names != nil && time.Since(set.loadedAt) < commandsRefresh {
+		return false, nil
+	}
+
+	reply, err := c.Do("CMDS")
+	if err != nil {
+		return false, err
+	}
+	cmds, ok := reply.(map[string]interface{})
+	if !ok {
+		// the list is unavailable, let the broadcast server decide
+		return true, nil
+	}
+	set.names = make(map[string]bool)
+	for name, v := range cmds {
+		if cmd, ok := v.(map[string]interface{}); ok && cmd["FireForget"] == true {
+			continue
+		}
+		set.names[strings.ToUpper(name)] = true
+	}
+	set.loadedAt = time.Now()
+	return set.names[cmd], nil
+}
@@ -0,0 +1,171 @@
+package webterm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nyxtom/webterm/glob"
+)
+
+// filesPrefix is where the file api is mounted, the rest of the url is the
+// path of the file relative to the home directory
+const filesPrefix = "/api/files/"
+
+// missingFileVersion is the version edit replies with for files that don't exist
+const missingFileVersion = "0"
+
+// files serves the home directory of the broadcast server over plain http:
+//
+//	GET    /api/files/{path}  contents of a file (Range and ETag aware) or the listing of a directory
+//	PUT    /api/files/{path}  saves the request body, If-Match or If-None-Match: * guard against overwrites
+//	DELETE /api/files/{path}  removes a file, directories need ?recursive=1
+//
+// Every request runs the same edit, ls, save and rm commands as the terminal
+// does so the same sandbox, policy and audit log apply.
+func (handler *Handler) files(w http.ResponseWriter, req *http.Request) {
+	name := "/" + strings.TrimPrefix(req.URL.Path, handler.base+filesPrefix)
+	switch req.Method {
+	case "GET", "HEAD":
+		handler.getFile(w, req, name)
+	case "PUT":
+		handler.putFile(w, req, name)
+	case "DELETE":
+		args := []interface{}{glob.Escape(name)}
+		if req.URL.Query().Get("recursive") == "1" {
+			args = append([]interface{}{"-r"}, args...)
+		}
+		resp := handler.fileCommand(req, "RM", args)
+		handler.record(sessionOf(req.Context()), req.RemoteAddr, resp)
+		if resp.Error != nil {
+			handler.writeResponse(w, resp)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		handler.writeResponse(w, newExecResponse("", nil).fail(
+			newExecError(http.StatusMethodNotAllowed, "method_not_allowed", req.Method+" is not supported")))
+	}
+}
+
+// getFile writes the contents of a file, directories are listed instead
+func (handler *Handler) getFile(w http.ResponseWriter, req *http.Request, name string) {
+	resp := handler.fileCommand(req, "EDIT", []interface{}{glob.Escape(name)})
+	if resp.Error != nil && strings.HasSuffix(resp.Error.Message, "is a directory") {
+		handler.listDir(w, req, name)
+		return
+	}
+
+	reply, _ := resp.Reply.(map[string]interface{})
+	version, _ := reply["version"].(string)
+	contents, _ := reply["contents"].(string)
+	if resp.Error == nil && version == missingFileVersion {
+		resp.fail(newExecError(http.StatusNotFound, "not_found", "edit "+name+": no such file or directory"))
+	}
+	content := []byte(contents)
+	if resp.Error == nil && reply["encoding"] == "base64" {
+		var err error
+		if content, err = base64.StdEncoding.DecodeString(contents); err != nil {
+			resp.fail(newExecError(http.StatusBadGateway, "backend_error", "invalid contents of "+name+": "+err.Error()))
+		}
+	}
+	handler.record(sessionOf(req.Context()), req.RemoteAddr, resp)
+	if resp.Error != nil {
+		handler.writeResponse(w, resp)
+		return
+	}
+
+	// ServeContent takes care of ranges and the conditional headers
+	w.Header().Set("ETag", `"`+version+`"`)
+	http.ServeContent(w, req, name, time.Time{}, bytes.NewReader(content))
+}
+
+// listDir writes the entries of a directory as json
+func (handler *Handler) listDir(w http.ResponseWriter, req *http.Request, name string) {
+	resp := handler.fileCommand(req, "LS", []interface{}{"-a", glob.Escape(name)})
+	reply, _ := resp.Reply.(map[string]interface{})
+	listings, _ := reply["listings"].([]interface{})
+	listing := map[string]interface{}{}
+	if resp.Error == nil && len(listings) == 0 {
+		resp.fail(newExecError(http.StatusNotFound, "not_found", "ls "+name+": no such file or directory"))
+	} else if resp.Error == nil {
+		listing, _ = listings[0].(map[string]interface{})
+		if msg, ok := listing["error"].(string); ok && msg != "" {
+			resp.fail(fileError(msg))
+		}
+	}
+	handler.record(sessionOf(req.Context()), req.RemoteAddr, resp)
+	if resp.Error != nil {
+		handler.writeResponse(w, resp)
+		return
+	}
+	listing["path"] = name
+	listing["truncated"] = reply["truncated"] == true
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listing)
+}
+
+// putFile saves the body of the request as the contents of the file
+func (handler *Handler) putFile(w http.ResponseWriter, req *http.Request, name string) {
+	content, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxExecBody))
+	if err != nil {
+		handler.writeResponse(w, newExecResponse("SAVE", nil).fail(errBadRequest("invalid request body: "+err.Error())))
+		return
+	}
+
+	args := []interface{}{glob.Escape(name), string(content)}
+	if match := req.Header.Get("If-Match"); match != "" && match != "*" {
+		args = append(args, strings.Trim(match, `"`))
+	} else if req.Header.Get("If-None-Match") == "*" {
+		// only create the file, saving against the version of a missing file
+		args = append(args, missingFileVersion)
+	}
+	resp := handler.fileCommand(req, "SAVE", args)
+	handler.record(sessionOf(req.Context()), req.RemoteAddr, resp)
+	if resp.Error != nil {
+		// don't echo the contents back
+		resp.Args = resp.Args[:1]
+		handler.writeResponse(w, resp)
+		return
+	}
+
+	reply, _ := resp.Reply.(map[string]interface{})
+	version, _ := reply["version"].(string)
+	w.Header().Set("ETag", `"`+version+`"`)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"path": name, "version": version})
+}
+
+// fileCommand runs a command of the file api for the session of the request,
+// failures of the command are mapped onto the matching http errors. The
+// caller records the response once it is final.
+func (handler *Handler) fileCommand(req *http.Request, cmd string, args []interface{}) *execResponse {
+	resp := newExecResponse(cmd, args)
+	handler.runPooled(req, "", resp)
+	if resp.Error != nil && resp.Error.Code == "command_failed" {
+		resp.Error = fileError(resp.Error.Message)
+	}
+	return resp
+}
+
+// fileError maps the error message of a file command onto an http error
+func fileError(msg string) *ExecError {
+	switch {
+	case strings.Contains(msg, "no such file or directory"):
+		return newExecError(http.StatusNotFound, "not_found", msg)
+	case strings.Contains(msg, "conflict"):
+		return newExecError(http.StatusPreconditionFailed, "conflict", msg)
+	case strings.Contains(msg, "is a directory"), strings.Contains(msg, "not a directory"),
+		strings.Contains(msg, "directory not empty"):
+		return newExecError(http.StatusConflict, "command_failed", msg)
+	case strings.Contains(msg, "outside of the home directory"), strings.Contains(msg, "permission denied"):
+		return newExecError(http.StatusForbidden, "forbidden", msg)
+	}
+	return errCommandFailed(msg)
+}
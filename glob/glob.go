@@ -0,0 +1,98 @@
+// Package glob escapes the glob characters of the arguments sent to the
+// broadcast server. Clients protect the glob characters of quoted arguments
+// with a backslash so that the server never expands them, the server removes
+// the backslashes once it has resolved the paths. File contents are never
+// paths and are always sent as they are. Lines using pipes or redirections are
+// sent to sh whole instead of being split into arguments.
+package glob
+
+import "strings"
+
+// Meta are the characters protected with a backslash
+const Meta = `*?[]\`
+
+// Escape protects the glob characters of arg from being expanded
+func Escape(arg string) string {
+	if !strings.ContainsAny(arg, Meta) {
+		return arg
+	}
+	b := make([]byte, 0, len(arg)+4)
+	for i := 0; i < len(arg); i++ {
+		if strings.IndexByte(Meta, arg[i]) >= 0 {
+			b = append(b, '\\')
+		}
+		b = append(b, arg[i])
+	}
+	return string(b)
+}
+
+// Unescape removes the backslashes protecting glob characters from expansion
+func Unescape(arg string) string {
+	if !strings.Contains(arg, `\`) {
+		return arg
+	}
+	b := make([]byte, 0, len(arg))
+	for i := 0; i < len(arg); i++ {
+		if arg[i] == '\\' && i+1 < len(arg) && strings.IndexByte(Meta, arg[i+1]) >= 0 {
+			i++
+		}
+		b = append(b, arg[i])
+	}
+	return string(b)
+}
+
+// NeedsShell reports whether the line uses any shell operators (pipes or
+// redirections) outside of quotes, clients send such lines to sh as they are
+func NeedsShell(line string) bool {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '\\':
+			i++
+		case c == '|' || c == '<' || c == '>':
+			return true
+		}
+	}
+	return false
+}
+
+// HasMeta reports whether arg contains any glob characters that are not escaped
+func HasMeta(arg string) bool {
+	for i := 0; i < len(arg); i++ {
+		switch arg[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
+
+// ContentArg returns the index of the argument of cmd that holds the contents
+// of a file rather than a path, -1 when there is none. That argument is sent
+// and written as it is, without any escaping.
+//
+//	save [--force] filename filecontents [version]
+func ContentArg(cmd string, args []string) int {
+	if !strings.EqualFold(cmd, "save") {
+		return -1
+	}
+	i := 0
+	for i < len(args) && args[i] == "--force" {
+		i++
+	}
+	if i+1 >= len(args) {
+		return -1
+	}
+	return i + 1
+}
@@ -0,0 +1,101 @@
+package glob
+
+import "testing"
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		arg, escaped string
+	}{
+		{"notes.txt", "notes.txt"},
+		{"*.go", `\*.go`},
+		{"a?[b]", `a\?\[b\]`},
+		{`C:\dir`, `C:\\dir`},
+		{`\*`, `\\\*`},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := Escape(test.arg); got != test.escaped {
+			t.Errorf("Escape(%q) = %q, want %q", test.arg, got, test.escaped)
+		}
+		if got := Unescape(test.escaped); got != test.arg {
+			t.Errorf("Unescape(%q) = %q, want %q", test.escaped, got, test.arg)
+		}
+	}
+}
+
+func TestUnescapeKeepsOtherBackslashes(t *testing.T) {
+	tests := []struct {
+		arg, want string
+	}{
+		{`a\nb`, `a\nb`},
+		{`trailing\`, `trailing\`},
+		{`\d+\.go`, `\d+\.go`},
+	}
+	for _, test := range tests {
+		if got := Unescape(test.arg); got != test.want {
+			t.Errorf("Unescape(%q) = %q, want %q", test.arg, got, test.want)
+		}
+	}
+}
+
+func TestHasMeta(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want bool
+	}{
+		{"notes.txt", false},
+		{"*.go", true},
+		{"file?", true},
+		{"[ab]", true},
+		{`\*.go`, false},
+		{`\\*.go`, true},
+		{"a]", false},
+	}
+	for _, test := range tests {
+		if got := HasMeta(test.arg); got != test.want {
+			t.Errorf("HasMeta(%q) = %v, want %v", test.arg, got, test.want)
+		}
+	}
+}
+
+func TestContentArg(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		args []string
+		want int
+	}{
+		{"SAVE", []string{"notes.txt", "hello"}, 1},
+		{"save", []string{"notes.txt", "hello", "v1"}, 1},
+		{"save", []string{"--force", "notes.txt", "hello"}, 2},
+		{"save", []string{"notes.txt"}, -1},
+		{"save", []string{"--force", "notes.txt"}, -1},
+		{"cat", []string{"a", "b"}, -1},
+	}
+	for _, test := range tests {
+		if got := ContentArg(test.cmd, test.args); got != test.want {
+			t.Errorf("ContentArg(%q, %q) = %d, want %d", test.cmd, test.args, got, test.want)
+		}
+	}
+}
+
+func TestNeedsShell(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"ls -l", false},
+		{"cat a | grep b", true},
+		{"ls > out", true},
+		{"grep a < in", true},
+		{`echo "a | b"`, false},
+		{`echo 'a > b'`, false},
+		{`echo a\|b`, false},
+		{`echo "say \"|\"" | grep say`, true},
+		{`echo "unterminated |`, false},
+	}
+	for _, test := range tests {
+		if got := NeedsShell(test.line); got != test.want {
+			t.Errorf("NeedsShell(%q) = %v, want %v", test.line, got, test.want)
+		}
+	}
+}
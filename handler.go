@@ -0,0 +1,555 @@
+package webterm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nyxtom/webterm/audit"
+	"github.com/nyxtom/webterm/glob"
+	"github.com/nyxtom/webterm/policy"
+)
+
+// Logger receives the log output of the handler, the workclient of the
+// webterm server is one
+type Logger interface {
+	LogInfo(msg string)
+	LogInfoF(format string, args ...interface{})
+	LogErr(err error)
+}
+
+// stdLogger logs through the log package when no logger is configured
+type stdLogger struct{}
+
+func (stdLogger) LogInfo(msg string)                          { log.Println(msg) }
+func (stdLogger) LogInfoF(format string, args ...interface{}) { log.Printf(format, args...) }
+func (stdLogger) LogErr(err error)                            { log.Println("error:", err) }
+
+// Conn is a connection to the server running the terminal commands
+type Conn interface {
+	Do(cmd string, args ...interface{}) (interface{}, error)
+	Close()
+}
+
+// Backend hands out connections to the server running the terminal commands,
+// a ClientPool of broadcast connections unless another one is configured
+type Backend interface {
+	// Get returns a shared connection which must be handed back through Put
+	Get() (Conn, error)
+	// Put hands a connection back, err is that of the last command sent on it
+	Put(c Conn, err error)
+	// Dial returns a connection of its own which the caller closes
+	Dial() (Conn, error)
+	// Close closes every connection of the backend
+	Close()
+}
+
+// HandlerConfig configures the web terminal handler
+type HandlerConfig struct {
+	// path the handler is mounted at, such as "/term" (empty for the root)
+	BasePath string `toml:"base_path"`
+
+	// broadcast configuration
+	BroadcastPort  int    `toml:"broadcast_port" default:"7337"`
+	BroadcastIP    string `toml:"broadcast_ip" default:"127.0.0.1"`
+	BroadcastProto string `toml:"broadcast_proto" default:"redis"`
+
+	// broadcast connection pool configuration
+	BroadcastMaxIdle     int           `toml:"broadcast_max_idle" default:"8"`
+	BroadcastMaxActive   int           `toml:"broadcast_max_active" default:"64"`
+	BroadcastDialTimeout time.Duration `toml:"broadcast_dial_timeout" default:"5s"`
+	BroadcastIdleTimeout time.Duration `toml:"broadcast_idle_timeout" default:"5m"`
+
+	// broadcast command whose reply is shown as the terminal greeting
+	GreetingCmd string `toml:"greeting_cmd" default:"resume"`
+
+	// directory to serve the web ui from instead of the copy built into the binary
+	AssetsDir string `toml:"assets_dir"`
+
+	// authentication, users_file lists the accounts (logins are disabled without one)
+	UsersFile     string        `toml:"users_file"`
+	SessionSecret string        `toml:"session_secret"`
+	SessionTTL    time.Duration `toml:"session_ttl" default:"12h"`
+
+	// append-only log of every command run from a browser (json lines)
+	AuditFile       string `toml:"audit_file"`
+	AuditMaxSize    int64  `toml:"audit_max_size" default:"10485760"`
+	AuditMaxBackups int    `toml:"audit_max_backups" default:"5"`
+
+	// commands and paths allowed for the roles of logged in users
+	Policy policy.Config `toml:"policy"`
+
+	// serve the metrics of the handler at /metrics (healthz and readyz are always served)
+	Metrics bool `toml:"metrics"`
+
+	// access log of every request, combined (apache) or json format, or off
+	AccessLogFormat string `toml:"access_log_format" default:"combined"`
+	AccessLogFile   string `toml:"access_log_file"`
+
+	// Backend replaces the pool of broadcast connections made from the settings above
+	Backend Backend `toml:"-"`
+	// Logger receives the log output, the log package is used when nil
+	Logger Logger `toml:"-"`
+}
+
+// Handler is the web terminal as an http.Handler with its own routes, so that
+// it can be mounted in any go http server
+//
+//	handler, err := webterm.NewHandler(&webterm.HandlerConfig{BasePath: "/term", BroadcastPort: 7337})
+//	http.Handle("/term/", handler)
+type Handler struct {
+	Logger
+	base       string
+	mux        *http.ServeMux
+	chain      http.Handler
+	middleware []Middleware
+	accessLog  *os.File
+	backend    Backend
+	commands   commandSet
+	auth       *Auth
+	assets     *Assets
+	policy     *policy.Policy
+	audit      *audit.Logger
+	greetCmd   string
+	metrics    *webMetrics
+}
+
+// NewHandler loads the users, policy, audit log and assets of the config and
+// returns the handler serving the terminal under its base path, the fields left
+// zero are given the value of their default tag
+func NewHandler(config *HandlerConfig) (*Handler, error) {
+	defaults := *config
+	config = &defaults
+	if err := applyDefaults(config); err != nil {
+		return nil, err
+	}
+
+	handler := new(Handler)
+	handler.Logger = config.Logger
+	if handler.Logger == nil {
+		handler.Logger = stdLogger{}
+	}
+	handler.base = strings.TrimRight(config.BasePath, "/")
+	if handler.base != "" && !strings.HasPrefix(handler.base, "/") {
+		return nil, errors.New("base_path must start with a /")
+	}
+	handler.backend = config.Backend
+	if handler.backend == nil {
+		handler.backend = NewClientPool(&PoolConfig{
+			Port:        config.BroadcastPort,
+			IP:          config.BroadcastIP,
+			Protocol:    config.BroadcastProto,
+			MaxIdle:     config.BroadcastMaxIdle,
+			MaxActive:   config.BroadcastMaxActive,
+			DialTimeout: config.BroadcastDialTimeout,
+			IdleTimeout: config.BroadcastIdleTimeout,
+		})
+	}
+	handler.greetCmd = config.GreetingCmd
+
+	var err error
+	if handler.assets, err = NewAssets(config.AssetsDir); err != nil {
+		return nil, err
+	}
+	if config.UsersFile != "" {
+		if handler.auth, err = NewAuth(config.UsersFile, config.SessionSecret, config.SessionTTL); err != nil {
+			return nil, err
+		}
+	}
+	if handler.policy, err = policy.New(&config.Policy); err != nil {
+		return nil, err
+	}
+	if config.AuditFile != "" {
+		if handler.audit, err = audit.Open(config.AuditFile, config.AuditMaxSize, config.AuditMaxBackups); err != nil {
+			return nil, err
+		}
+	}
+
+	var out io.Writer
+	if config.AccessLogFile != "" && config.AccessLogFormat != "off" {
+		if handler.accessLog, err = os.OpenFile(config.AccessLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640); err != nil {
+			return nil, err
+		}
+		out = handler.accessLog
+	}
+
+	if handler.auth == nil {
+		handler.LogInfo("WARNING: no users_file configured, anyone who can reach the server can use the terminal")
+	} else if handler.auth.ttl <= 0 {
+		handler.LogInfo("WARNING: session_ttl is not set, sessions expire immediately")
+	}
+	if handler.policy != nil && handler.policy.Secret() == "" {
+		handler.LogInfo("WARNING: the policy has no identify_secret, the broadcast server gives every command of the web server the connection role")
+	}
+	if handler.audit != nil && handler.policy.Secret() == "" {
+		handler.LogInfo("WARNING: the policy has no identify_secret, an audit log of webterm-broadcast records the commands of the web server a second time")
+	}
+
+	handler.metrics = newWebMetrics(handler)
+	handler.mux = http.NewServeMux()
+	handler.handle("/healthz", handler.healthz)
+	handler.handle("/readyz", handler.readyz)
+	if config.Metrics {
+		handler.handle("/metrics", handler.metrics.registry.Handler().ServeHTTP)
+	}
+	handler.handle("/login", handler.login)
+	handler.handle("/logout", handler.logout, handler.requireSession)
+	handler.handle("/sessions", handler.sessions, handler.requireSession)
+	handler.handle("/exec", handler.exec, handler.requireSession)
+	handler.handle("/ws", handler.websocket, handler.requireSession)
+	handler.handle(filesPrefix, handler.files, handler.requireSession)
+	handler.handle("/", handler.index, handler.requireSession)
+	for _, dir := range assetDirs {
+		prefix := handler.base + "/" + dir + "/"
+		handler.mux.Handle(prefix, handler.instrument("/"+dir+"/")(handler.assets.Handler(prefix, dir)))
+	}
+
+	// every request gets an id, is logged and can't take the connection down with a panic
+	handler.Use(RequestID)
+	if config.AccessLogFormat != "off" {
+		handler.Use(AccessLog(config.AccessLogFormat, out, handler.Logger))
+	}
+	handler.Use(Recover(handler.Logger))
+	return handler, nil
+}
+
+// applyDefaults sets the zero fields of the config to the value of their
+// default tag
+func applyDefaults(config *HandlerConfig) error {
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		value, ok := v.Type().Field(i).Tag.Lookup("default")
+		field := v.Field(i)
+		if !ok || !field.IsZero() {
+			continue
+		}
+		switch {
+		case field.Type() == reflect.TypeOf(time.Duration(0)):
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			field.SetInt(int64(d))
+		case field.Kind() == reflect.String:
+			field.SetString(value)
+		case field.Kind() == reflect.Int || field.Kind() == reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return err
+			}
+			field.SetInt(n)
+		default:
+			return errors.New("unsupported default for " + v.Type().Field(i).Name)
+		}
+	}
+	return nil
+}
+
+// Use wraps every request to the handler in the given middleware, the first
+// one given runs first (after the request id, access log and panic recovery
+// of the handler itself). Middleware must be added before serving requests.
+func (handler *Handler) Use(middleware ...Middleware) {
+	handler.middleware = append(handler.middleware, middleware...)
+	handler.chain = Chain(handler.mux, handler.middleware...)
+}
+
+// logger returns the logger of the handler prefixing the id of the request
+func (handler *Handler) logger(req *http.Request) Logger {
+	return requestLogger(handler.Logger, req)
+}
+
+// ServeHTTP serves the terminal page, its assets and the command endpoints
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	handler.chain.ServeHTTP(w, req)
+}
+
+// Close closes the connections of the backend and the audit log
+func (handler *Handler) Close() {
+	handler.backend.Close()
+	handler.audit.Close()
+	if handler.accessLog != nil {
+		handler.accessLog.Close()
+	}
+}
+
+func (handler *Handler) index(w http.ResponseWriter, req *http.Request) {
+	data := make(map[string]interface{})
+	data["Greeting"] = handler.greeting(req)
+	if session := sessionOf(req.Context()); session != nil {
+		data["User"] = session.User
+	}
+	handler.render(w, req, data)
+}
+
+// render writes the terminal page filled in with data
+func (handler *Handler) render(w http.ResponseWriter, req *http.Request, data map[string]interface{}) {
+	data["Base"] = handler.base
+	t, err := handler.assets.Index()
+	if err != nil {
+		handler.logger(req).LogErr(err)
+		http.Error(w, "unable to load the page", http.StatusInternalServerError)
+		return
+	}
+	if err := t.Execute(w, data); err != nil {
+		handler.logger(req).LogErr(err)
+	}
+}
+
+// greeting runs the configured greeting command on the broadcast server
+func (handler *Handler) greeting(req *http.Request) string {
+	if handler.greetCmd == "" {
+		return ""
+	}
+	c, err := handler.backend.Get()
+	if err != nil {
+		handler.logger(req).LogErr(err)
+		return ""
+	}
+	reply, err := c.Do(strings.ToUpper(handler.greetCmd))
+	handler.backend.Put(c, err)
+	if err != nil {
+		handler.logger(req).LogErr(err)
+		return ""
+	}
+	return replyString(reply)
+}
+
+func (handler *Handler) exec(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	session := sessionOf(req.Context())
+	var cmd, cwd string
+	var args []interface{}
+	if req.Method == "POST" {
+		body := &execRequest{}
+		dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxExecBody))
+		if err := dec.Decode(body); err != nil {
+			resp := newExecResponse("", nil).fail(errBadRequest("invalid request body: " + err.Error()))
+			handler.record(session, req.RemoteAddr, resp)
+			handler.writeResponse(w, resp)
+			return
+		}
+		cmd = strings.ToUpper(body.Cmd)
+		decoded, err := decodeArgs(cmd, body.Args)
+		if err != nil {
+			resp := newExecResponse(cmd, nil).fail(errBadRequest(err.Error()))
+			handler.record(session, req.RemoteAddr, resp)
+			handler.writeResponse(w, resp)
+			return
+		}
+		args, cwd = decoded, body.Cwd
+	} else if req.Method == "GET" {
+		values := req.URL.Query()
+		cmd, args = parseCommand(values.Get("cmd"))
+		cwd = values.Get("cwd")
+	} else {
+		w.Header().Set("Allow", "GET, POST")
+		handler.writeResponse(w, newExecResponse("", nil).fail(
+			newExecError(http.StatusMethodNotAllowed, "method_not_allowed", req.Method+" is not supported")))
+		return
+	}
+
+	resp := newExecResponse(cmd, args)
+	resp.start = start
+	if cmd == "" {
+		handler.writeResponse(w, resp)
+		return
+	}
+
+	handler.runPooled(req, cwd, resp)
+	handler.record(session, req.RemoteAddr, resp)
+	handler.writeResponse(w, resp)
+}
+
+// runPooled runs the command of the response for the session of the request
+// on a pooled connection, starting from the working directory cwd. When cwd
+// is empty the command runs from the home directory without touching the
+// directories of the session.
+func (handler *Handler) runPooled(req *http.Request, cwd string, resp *execResponse) {
+	session := sessionOf(req.Context())
+	c, err := handler.backend.Get()
+	if err != nil {
+		handler.logger(req).LogErr(err)
+		resp.fail(errUnavailable(err))
+		return
+	}
+	// pooled connections are shared between browsers, always restore the
+	// working directory of this one so another's is never used
+	keepDirs := cwd != ""
+	if cwd == "" {
+		cwd = "/"
+	}
+	if err = handler.identify(c, session, keepDirs); err == nil {
+		if _, err = c.Do("CD", cwd); err == nil {
+			err = handler.run(c, session, resp, nil)
+		}
+	}
+	handler.backend.Put(c, err)
+	if err != nil {
+		handler.logger(req).LogErr(err)
+		resp.fail(errUnavailable(err))
+	}
+}
+
+// run executes the command of the response on the broadcast client, filling
+// in the reply (or the error) and the resulting working directory. Errors
+// returned are those of the connection to the broadcast server. See do for
+// the batches of streamed replies.
+func (handler *Handler) run(c Conn, session *Session, resp *execResponse, batch func(interface{}) error) error {
+	known, err := handler.commands.known(c, resp.Cmd)
+	if err != nil {
+		return err
+	}
+	if !known {
+		resp.fail(errUnknownCommand(resp.Cmd))
+	} else if err := handler.authorize(session, resp.Cmd); err != nil {
+		resp.fail(errForbidden(err.Error()))
+	} else if err := handler.do(c, resp, batch); err != nil {
+		return err
+	}
+
+	cwd, err := c.Do("PWD")
+	if err != nil {
+		return err
+	}
+	resp.Cwd = replyString(cwd)
+	return nil
+}
+
+// do sends the command to the broadcast server, denials and other error
+// replies are turned into the matching errors of the response. The batches of
+// streamed replies are handed to batch as they arrive, the last one becomes
+// the reply. Without batch they are joined into one reply.
+func (handler *Handler) do(c Conn, resp *execResponse, batch func(interface{}) error) error {
+	reply, err := c.Do(resp.Cmd, resp.Args...)
+	for err == nil && isBatch(reply) {
+		var next interface{}
+		if batch == nil {
+			if next, err = c.Do("MORE"); err == nil {
+				reply = joinBatches(reply.(map[string]interface{}), next)
+			}
+		} else if err = batch(reply); err == nil {
+			reply, err = c.Do("MORE")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if e, ok := reply.(error); ok && policy.IsDenied(e.Error()) {
+		resp.fail(errForbidden(e.Error()))
+	} else if ok {
+		resp.fail(errCommandFailed(e.Error()))
+	} else {
+		resp.Reply = printReply(resp.Cmd, reply, "")
+	}
+	if resp.Cmd == "AUDIT" {
+		handler.mergeAudit(resp)
+	}
+	return nil
+}
+
+// parseCommand splits the line into a command and its arguments, lines using
+// pipes or redirections are evaluated by the broadcast server through SH
+func parseCommand(line string) (string, []interface{}) {
+	if glob.NeedsShell(line) {
+		return "SH", []interface{}{line}
+	}
+
+	reg, _ := regexp.Compile(`'.*?'|".*?"|\S+`)
+	cmds := reg.FindAllString(line, -1)
+	if len(cmds) == 0 {
+		return "", nil
+	}
+	args := make([]interface{}, len(cmds[1:]))
+	for i := range args {
+		item := strings.Trim(string(cmds[1+i]), "\"'")
+		if item != cmds[1+i] {
+			// quoted arguments are never glob expanded by the server
+			item = glob.Escape(item)
+		}
+		if a, err := strconv.Atoi(item); err == nil {
+			args[i] = a
+		} else if a, err := strconv.ParseFloat(item, 64); err == nil {
+			args[i] = a
+		} else if a, err := strconv.ParseBool(item); err == nil {
+			args[i] = a
+		} else if len(item) == 1 {
+			b := []byte(item)
+			args[i] = string(b[0])
+		} else {
+			args[i] = item
+		}
+	}
+	cmd := strings.ToUpper(cmds[0])
+	literalContent(cmd, args)
+	return cmd, args
+}
+
+func printReply(cmd string, reply interface{}, indent string) interface{} {
+	switch reply := reply.(type) {
+	case []byte:
+		return fmt.Sprintf("%q\n", reply)
+	case nil:
+		return fmt.Sprintf("(nil)\n")
+	case error:
+		return fmt.Sprintf("%s\n", string(reply.Error()))
+	}
+
+	return reply
+}
+
+// isBatch reports whether the reply is a batch of a streamed reply followed by
+// more, grep and find write their results a batch at a time and every batch
+// but the last has more set. The next batch is read by sending MORE.
+func isBatch(reply interface{}) bool {
+	m, ok := reply.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	more, _ := m["more"].(bool)
+	return more
+}
+
+// joinBatches appends the lists of the next batch of a streamed reply to those
+// of the batches before it, other fields are taken from the next batch
+func joinBatches(reply map[string]interface{}, next interface{}) interface{} {
+	batch, ok := next.(map[string]interface{})
+	if !ok {
+		return next
+	}
+	delete(reply, "more")
+	for k, v := range batch {
+		list, isList := v.([]interface{})
+		if prev, ok := reply[k].([]interface{}); ok && isList {
+			reply[k] = append(prev, list...)
+		} else {
+			reply[k] = v
+		}
+	}
+	return reply
+}
+
+// replyString returns the raw text of a string reply without any formatting
+func replyString(reply interface{}) string {
+	switch reply := reply.(type) {
+	case []byte:
+		return string(reply)
+	case string:
+		return reply
+	}
+	return ""
+}
+
+// handle routes the path (below the base path) to fn wrapped in the middleware
+func (handler *Handler) handle(path string, fn http.HandlerFunc, middleware ...Middleware) {
+	middleware = append([]Middleware{handler.instrument(path)}, middleware...)
+	handler.mux.Handle(handler.base+path, Chain(fn, middleware...))
+}
@@ -0,0 +1,60 @@
+package webterm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewHandlerAppliesDefaults(t *testing.T) {
+	config := &HandlerConfig{Logger: discardLogger{}}
+	handler, err := NewHandler(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+
+	if config.GreetingCmd != "" {
+		t.Error("NewHandler changed the config it was given")
+	}
+	if handler.greetCmd != "resume" {
+		t.Errorf("greeting command %q, want resume", handler.greetCmd)
+	}
+	pool, ok := handler.backend.(*ClientPool)
+	if !ok {
+		t.Fatalf("backend %T, want a *ClientPool", handler.backend)
+	}
+	want := PoolConfig{
+		Port:        7337,
+		IP:          "127.0.0.1",
+		Protocol:    "redis",
+		MaxIdle:     8,
+		MaxActive:   64,
+		DialTimeout: 5 * time.Second,
+		IdleTimeout: 5 * time.Minute,
+	}
+	if *pool.config != want {
+		t.Errorf("pool config %+v, want %+v", *pool.config, want)
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	config := &HandlerConfig{BroadcastPort: 9000, AccessLogFormat: "json"}
+	if err := applyDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	if config.BroadcastPort != 9000 || config.AccessLogFormat != "json" {
+		t.Errorf("fields that were set were changed: %+v", config)
+	}
+	if config.SessionTTL != 12*time.Hour || config.AuditMaxSize != 10485760 || config.AuditMaxBackups != 5 {
+		t.Errorf("defaults not applied: %+v", config)
+	}
+	if config.BasePath != "" || config.Metrics {
+		t.Errorf("fields without a default were set: %+v", config)
+	}
+}
+
+type discardLogger struct{}
+
+func (discardLogger) LogInfo(msg string)                          {}
+func (discardLogger) LogInfoF(format string, args ...interface{}) {}
+func (discardLogger) LogErr(err error)                            {}
@@ -0,0 +1,189 @@
+package webterm
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// requireSession is the middleware letting only logged in browsers through.
+// Pages redirect to the login page, everything else is refused with a 401
+// error envelope.
+func (handler *Handler) requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if handler.auth == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		var session *Session
+		cookie, err := req.Cookie(sessionCookie)
+		if err == nil {
+			session, err = handler.auth.Session(cookie.Value)
+		}
+		if err != nil {
+			if session = handler.certSession(req); session != nil {
+				err = nil
+			}
+		}
+		if err != nil {
+			if req.URL.Path == handler.base+"/" || strings.Contains(req.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, req, handler.base+"/login", http.StatusFound)
+				return
+			}
+			handler.writeResponse(w, newExecResponse("", nil).fail(
+				newExecError(http.StatusUnauthorized, "unauthorized", err.Error())))
+			return
+		}
+		if info := infoOf(req.Context()); info != nil {
+			info.Lock()
+			info.user = session.User
+			info.Unlock()
+		}
+		next.ServeHTTP(w, req.WithContext(withSession(req.Context(), session)))
+	})
+}
+
+// identify tells the broadcast server which user the commands sent on the
+// connection are run for so that it enforces the same policy, the identify
+// secret of the policy shows the connection is the web server's. Without a
+// session the connection is only marked as the web server's, the broadcast
+// server then gives it the default role. With keepDirs the connection
+// continues the directories (previous directory and directory stack) of the
+// session's earlier commands, otherwise it starts from the home directory.
+// Without an identify secret the connection is not identified but its
+// directories are still those of the session, or the home directory.
+func (handler *Handler) identify(c Conn, session *Session, keepDirs bool) error {
+	secret := handler.policy.Secret()
+	if secret == "" {
+		args := []interface{}{}
+		if session != nil && keepDirs {
+			args = append(args, session.ID)
+		}
+		return replyErr(c.Do("SESSION", args...))
+	}
+	args := []interface{}{secret}
+	if session != nil && keepDirs {
+		args = append(args, "--dirs", session.ID)
+	}
+	if session != nil {
+		args = append(args, session.User)
+		for _, role := range handler.roles(session) {
+			args = append(args, role)
+		}
+	}
+	return replyErr(c.Do("IDENTIFY", args...))
+}
+
+// replyErr returns the error of a command sent to the broadcast server, that
+// of the connection or the error reply
+func replyErr(reply interface{}, err error) error {
+	if e, ok := reply.(error); ok && err == nil {
+		err = e
+	}
+	return err
+}
+
+// roles returns the roles of the user of a session
+func (handler *Handler) roles(session *Session) []string {
+	if session == nil {
+		return nil
+	}
+	if user := handler.auth.User(session); user != nil {
+		return user.Roles
+	}
+	return nil
+}
+
+// authorize checks that the policy allows the user of the session to run cmd,
+// requests without a session get the default role
+func (handler *Handler) authorize(session *Session, cmd string) error {
+	return handler.policy.AllowCommand(handler.roles(session), cmd)
+}
+
+// login shows the login page and logs in the user posted from it
+func (handler *Handler) login(w http.ResponseWriter, req *http.Request) {
+	if handler.auth == nil {
+		http.Redirect(w, req, handler.base+"/", http.StatusFound)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["Login"] = true
+	if req.Method == "POST" {
+		name := req.PostFormValue("username")
+		session, err := handler.auth.Login(name, req.PostFormValue("password"), req.RemoteAddr)
+		if err == nil {
+			handler.logger(req).LogInfoF("%s logged in from %s", name, req.RemoteAddr)
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookie,
+				Value:    handler.auth.Cookie(session),
+				Path:     handler.base + "/",
+				Expires:  session.Expires,
+				HttpOnly: true,
+				Secure:   req.TLS != nil,
+				SameSite: http.SameSiteStrictMode,
+			})
+			http.Redirect(w, req, handler.base+"/", http.StatusFound)
+			return
+		}
+		handler.logger(req).LogInfoF("failed login for %q from %s", name, req.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		data["Error"] = err.Error()
+		data["Username"] = name
+	}
+
+	handler.render(w, req, data)
+}
+
+// logout ends the session of the browser
+func (handler *Handler) logout(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "logout must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+	if session := sessionOf(req.Context()); session != nil {
+		handler.auth.Revoke(session.User, session.ID)
+		handler.logger(req).LogInfoF("%s logged out", session.User)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: handler.base + "/", MaxAge: -1, HttpOnly: true})
+	http.Redirect(w, req, handler.base+"/login", http.StatusFound)
+}
+
+// sessions lists the sessions of the logged in user (GET) or revokes one of
+// them by id (DELETE /sessions?id=...)
+func (handler *Handler) sessions(w http.ResponseWriter, req *http.Request) {
+	session := sessionOf(req.Context())
+	if session == nil {
+		handler.writeResponse(w, newExecResponse("", nil).fail(
+			newExecError(http.StatusNotFound, "not_found", "authentication is disabled")))
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		type sessionInfo struct {
+			Session
+			Current bool `json:"current"`
+		}
+		list := []sessionInfo{}
+		for _, s := range handler.auth.Sessions(session.User) {
+			list = append(list, sessionInfo{s, s.ID == session.ID})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case "DELETE":
+		id := strings.TrimSpace(req.URL.Query().Get("id"))
+		if !handler.auth.Revoke(session.User, id) {
+			handler.writeResponse(w, newExecResponse("", nil).fail(
+				newExecError(http.StatusNotFound, "not_found", "no such session "+id)))
+			return
+		}
+		handler.logger(req).LogInfoF("%s revoked session %s", session.User, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, req.Method+" is not supported", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,123 @@
+package webterm
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nyxtom/webterm/metrics"
+)
+
+// webMetrics are the metrics of the handler, served at /metrics
+type webMetrics struct {
+	registry        *metrics.Registry
+	requests        *metrics.Counter
+	requestDuration *metrics.Histogram
+	commands        *metrics.Counter
+	commandDuration *metrics.Histogram
+	websockets      *metrics.Gauge
+}
+
+// statsBackend is a backend able to report on its connections, as the ClientPool is
+type statsBackend interface {
+	Stats() PoolStats
+}
+
+func newWebMetrics(handler *Handler) *webMetrics {
+	r := metrics.NewRegistry()
+	m := &webMetrics{registry: r}
+	m.requests = r.NewCounter("webterm_http_requests_total", "Number of http requests by route, method and status code.", "route", "method", "code")
+	m.requestDuration = r.NewHistogram("webterm_http_request_duration_seconds", "Time taken to answer http requests by route.", metrics.DefaultBuckets, "route")
+	m.commands = r.NewCounter("webterm_commands_total", "Number of commands run by command and status.", "command", "status")
+	m.commandDuration = r.NewHistogram("webterm_command_duration_seconds", "Time taken to run commands by command.", metrics.DefaultBuckets, "command")
+	m.websockets = r.NewGauge("webterm_websockets", "Number of open websocket connections.")
+	m.websockets.Set(0)
+
+	if handler.auth != nil {
+		r.NewGaugeFunc("webterm_sessions", "Number of logged in sessions.", func() float64 {
+			return float64(handler.auth.Count())
+		})
+	}
+	if backend, ok := handler.backend.(statsBackend); ok {
+		r.NewGaugeFunc("webterm_broadcast_connections_idle", "Number of idle connections to the broadcast server.", func() float64 {
+			return float64(backend.Stats().Idle)
+		})
+		r.NewGaugeFunc("webterm_broadcast_connections_active", "Number of pooled connections to the broadcast server in use.", func() float64 {
+			return float64(backend.Stats().Active)
+		})
+		r.NewCounterFunc("webterm_broadcast_dials_total", "Number of connections made to the broadcast server.", func() float64 {
+			return float64(backend.Stats().Dials)
+		})
+		r.NewCounterFunc("webterm_broadcast_dial_errors_total", "Number of failed attempts to connect to the broadcast server.", func() float64 {
+			return float64(backend.Stats().DialErrors)
+		})
+	}
+	metrics.RegisterRuntime(r)
+	return m
+}
+
+// instrument is the middleware counting the requests of a route and their duration
+func (handler *Handler) instrument(route string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			rw := &ResponseWriter{ResponseWriter: w}
+			next.ServeHTTP(rw, req)
+			status := rw.Status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			handler.metrics.requests.Inc(route, req.Method, strconv.Itoa(status))
+			handler.metrics.requestDuration.ObserveSince(start, route)
+		})
+	}
+}
+
+// observe counts a command that was run and its duration
+func (handler *Handler) observe(resp *execResponse) {
+	cmd, status := strings.ToLower(resp.Cmd), "ok"
+	if resp.Error != nil {
+		status = resp.Error.Code
+	}
+	if cmd == "" || status == "unknown_command" {
+		// commands typed by users are only labelled once they are known to exist
+		cmd = "unknown"
+	}
+	handler.metrics.commands.Inc(cmd, status)
+	handler.metrics.commandDuration.ObserveSince(resp.start, cmd)
+}
+
+// healthz answers as long as the process is up
+func (handler *Handler) healthz(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// readyz answers 200 when the broadcast server can be reached and the page
+// templates are loaded, 503 otherwise along with the failed checks
+func (handler *Handler) readyz(w http.ResponseWriter, req *http.Request) {
+	checks := map[string]string{"backend": "ok", "templates": "ok"}
+	ready := true
+
+	c, err := handler.backend.Get()
+	if err == nil {
+		_, err = c.Do("PING")
+		handler.backend.Put(c, err)
+	}
+	if err != nil {
+		checks["backend"] = err.Error()
+		ready = false
+	}
+	if _, err := handler.assets.Index(); err != nil {
+		checks["templates"] = err.Error()
+		ready = false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"ready": ready, "checks": checks})
+}
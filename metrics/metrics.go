@@ -0,0 +1,398 @@
+// Package metrics keeps counters, gauges and histograms in memory and writes
+// them out in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds (in seconds) of latency histograms
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// ByteBuckets are the upper bounds of histograms of sizes in bytes
+var ByteBuckets = []float64{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+// collector is any metric that can write itself out
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds the metrics of a process
+type Registry struct {
+	sync.Mutex
+
+	names      map[string]bool
+	collectors []collector
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(name string, c collector) {
+	r.Lock()
+	defer r.Unlock()
+	if r.names[name] {
+		panic("metrics: " + name + " is already registered")
+	}
+	r.names[name] = true
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteTo writes every metric of the registry in the text exposition format
+func (r *Registry) WriteTo(out io.Writer) (int64, error) {
+	r.Lock()
+	collectors := append([]collector{}, r.collectors...)
+	r.Unlock()
+
+	cw := &countingWriter{w: out}
+	w := bufio.NewWriter(cw)
+	for _, c := range collectors {
+		c.write(w)
+	}
+	err := w.Flush()
+	return cw.n, err
+}
+
+// Handler serves the metrics of the registry to a Prometheus scraper
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// vec is the set of series of a metric, one per combination of label values
+type vec struct {
+	sync.Mutex
+
+	name   string
+	help   string
+	kind   string
+	labels []string
+	series map[string]*series
+}
+
+type series struct {
+	labels  []string
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+func newVec(name, help, kind string, labels []string) *vec {
+	return &vec{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*series)}
+}
+
+// get returns the series of the label values, the lock must be held
+func (v *vec) get(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d labels, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: append([]string{}, values...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+// sorted returns the series ordered by their label values, the lock must be held
+func (v *vec) sorted() []*series {
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := make([]*series, len(keys))
+	for i, k := range keys {
+		list[i] = v.series[k]
+	}
+	return list
+}
+
+func (v *vec) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, escapeHelp(v.help), v.name, v.kind)
+}
+
+// Counter is a value that only goes up
+type Counter struct{ *vec }
+
+// NewCounter registers a counter with the given label names
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newVec(name, help, "counter", labels)}
+	r.register(name, c)
+	return c
+}
+
+// Inc adds one to the series of the label values
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds delta (which must not be negative) to the series of the label values
+func (c *Counter) Add(delta float64, values ...string) {
+	c.Lock()
+	c.get(values).value += delta
+	c.Unlock()
+}
+
+// Value returns the series of the label values
+func (c *Counter) Value(values ...string) float64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.get(values).value
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	c.header(w)
+	for _, s := range c.sorted() {
+		writeSample(w, c.name, c.labels, s.labels, "", "", s.value)
+	}
+}
+
+// Gauge is a value that goes up and down
+type Gauge struct{ *vec }
+
+// NewGauge registers a gauge with the given label names
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newVec(name, help, "gauge", labels)}
+	r.register(name, g)
+	return g
+}
+
+// Set sets the series of the label values
+func (g *Gauge) Set(value float64, values ...string) {
+	g.Lock()
+	g.get(values).value = value
+	g.Unlock()
+}
+
+// Add adds delta to the series of the label values
+func (g *Gauge) Add(delta float64, values ...string) {
+	g.Lock()
+	g.get(values).value += delta
+	g.Unlock()
+}
+
+// Value returns the series of the label values
+func (g *Gauge) Value(values ...string) float64 {
+	g.Lock()
+	defer g.Unlock()
+	return g.get(values).value
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.Lock()
+	defer g.Unlock()
+	g.header(w)
+	for _, s := range g.sorted() {
+		writeSample(w, g.name, g.labels, s.labels, "", "", s.value)
+	}
+}
+
+// valueFunc is a gauge or counter read from a function whenever it is written out
+type valueFunc struct {
+	*vec
+	fn func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by fn
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(name, &valueFunc{newVec(name, help, "gauge", nil), fn})
+}
+
+// NewCounterFunc registers a counter whose value is returned by fn, which
+// must only ever go up (such as a count kept by another package)
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(name, &valueFunc{newVec(name, help, "counter", nil), fn})
+}
+
+func (v *valueFunc) write(w *bufio.Writer) {
+	v.header(w)
+	writeSample(w, v.name, nil, nil, "", "", v.fn())
+}
+
+// Histogram counts observations into buckets
+type Histogram struct {
+	*vec
+	bounds []float64
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds and label names
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{newVec(name, help, "histogram", labels), append([]float64{}, buckets...)}
+	sort.Float64s(h.bounds)
+	r.register(name, h)
+	return h
+}
+
+// series returns the series of the label values with its buckets, the lock must be held
+func (h *Histogram) series(values []string) *series {
+	s := h.get(values)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(h.bounds))
+	}
+	return s
+}
+
+// Observe adds a value to the series of the label values
+func (h *Histogram) Observe(value float64, values ...string) {
+	h.Lock()
+	s := h.series(values)
+	for i, bound := range h.bounds {
+		if value <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += value
+	h.Unlock()
+}
+
+// ObserveSince observes the seconds elapsed since start
+func (h *Histogram) ObserveSince(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+// Stats returns the number and the sum of the observations of the label values
+func (h *Histogram) Stats(values ...string) (uint64, float64) {
+	h.Lock()
+	defer h.Unlock()
+	s := h.series(values)
+	return s.count, s.value
+}
+
+// Quantile estimates the q-quantile (0 < q <= 1) of the observations of the
+// label values as the upper bound of the bucket it falls into, +Inf when it
+// is above the last bucket and 0 without observations
+func (h *Histogram) Quantile(q float64, values ...string) float64 {
+	h.Lock()
+	defer h.Unlock()
+	s := h.series(values)
+	if s.count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(s.count)))
+	for i, bound := range h.bounds {
+		if s.buckets[i] >= rank {
+			return bound
+		}
+	}
+	return math.Inf(1)
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	h.header(w)
+	for _, s := range h.sorted() {
+		for i, bound := range h.bounds {
+			writeSample(w, h.name+"_bucket", h.labels, s.labels, "le", formatFloat(bound), float64(s.buckets[i]))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, s.labels, "le", "+Inf", float64(s.count))
+		writeSample(w, h.name+"_sum", h.labels, s.labels, "", "", s.value)
+		writeSample(w, h.name+"_count", h.labels, s.labels, "", "", float64(s.count))
+	}
+}
+
+// RegisterRuntime adds gauges of the go runtime and the process to the registry
+func RegisterRuntime(r *Registry) {
+	start := time.Now()
+	r.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	r.NewGaugeFunc("process_start_time_seconds", "Start time of the process since unix epoch in seconds.", func() float64 {
+		return float64(start.UnixNano()) / 1e9
+	})
+	r.register("go_memstats", &memStats{})
+}
+
+// memStats reads the memory statistics once for all of its gauges
+type memStats struct{}
+
+func (memStats) write(w *bufio.Writer) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	for _, g := range []struct {
+		name, help, kind string
+		value            float64
+	}{
+		{"go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", "gauge", float64(m.Alloc)},
+		{"go_memstats_sys_bytes", "Number of bytes obtained from the system.", "gauge", float64(m.Sys)},
+		{"go_memstats_heap_objects", "Number of allocated objects.", "gauge", float64(m.HeapObjects)},
+		{"go_memstats_mallocs_total", "Total number of mallocs.", "counter", float64(m.Mallocs)},
+		{"go_gc_runs_total", "Number of completed GC cycles.", "counter", float64(m.NumGC)},
+		{"go_gc_pause_seconds_total", "Total time spent in GC stop-the-world pauses.", "counter", float64(m.PauseTotalNs) / 1e9},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", g.name, g.help, g.name, g.kind)
+		writeSample(w, g.name, nil, nil, "", "", g.value)
+	}
+}
+
+// writeSample writes a single line, extra is an additional label such as le
+func writeSample(w *bufio.Writer, name string, labels, values []string, extra, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extra != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(label + `="` + escapeLabel(values[i]) + `"`)
+		}
+		if extra != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extra + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,255 @@
+package webterm
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// requestIDHeader carries the id of a request, one sent by a proxy in front
+// of the handler is kept
+const requestIDHeader = "X-Request-Id"
+
+// Middleware wraps a handler in another that runs before (and after) it
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h in the middleware, the first one given runs first
+func Chain(h http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// ResponseWriter records the status code and the size of a response
+type ResponseWriter struct {
+	http.ResponseWriter
+	Status int
+	Size   int64
+}
+
+// WriteHeader records the status code before writing it
+func (w *ResponseWriter) WriteHeader(status int) {
+	if w.Status == 0 {
+		w.Status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write counts the bytes of the body, the status defaults to 200 as it does for http
+func (w *ResponseWriter) Write(b []byte) (int, error) {
+	if w.Status == 0 {
+		w.Status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.Size += int64(n)
+	return n, err
+}
+
+// Flush sends any buffered data to the client
+func (w *ResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands the connection over to the caller, as the websocket upgrade does
+func (w *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not support hijacking")
+	}
+	if w.Status == 0 {
+		w.Status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+// requestInfo is what the middleware knows about a request, the user is
+// filled in once the session of the request is known
+type requestInfo struct {
+	sync.Mutex
+	id   string
+	user string
+}
+
+type requestInfoKey struct{}
+
+// infoOf returns the info of a request that passed through RequestID
+func infoOf(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// RequestID gives every request an id, sent back in the X-Request-Id header
+// and prefixed to everything the handler logs about the request
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(req.Context(), requestInfoKey{}, &requestInfo{id: id})
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// validRequestID reports whether an id sent by a client is safe to log
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// Recover answers requests whose handler panics with a 500 rather than
+// dropping the connection, the panic is logged along with its stack
+func Recover(logger Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			rw, ok := w.(*ResponseWriter)
+			if !ok {
+				rw = &ResponseWriter{ResponseWriter: w}
+			}
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				requestLogger(logger, req).LogErr(fmt.Errorf("panic serving %s %s: %v\n%s", req.Method, req.URL.Path, err, debug.Stack()))
+				if rw.Status == 0 {
+					http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				}
+			}()
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// AccessLog writes a line for every request once it is done, in the Apache
+// combined log format or as json (format "json"). Lines are written to out,
+// or to the logger when out is nil.
+func AccessLog(format string, out io.Writer, logger Logger) Middleware {
+	var lock sync.Mutex
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			rw := &ResponseWriter{ResponseWriter: w}
+			next.ServeHTTP(rw, req)
+
+			var line string
+			if format == "json" {
+				line = jsonAccessLine(req, rw, start)
+			} else {
+				line = combinedAccessLine(req, rw, start)
+			}
+			if out == nil {
+				logger.LogInfo(line)
+				return
+			}
+			lock.Lock()
+			io.WriteString(out, line+"\n")
+			lock.Unlock()
+		})
+	}
+}
+
+// combinedAccessLine formats a request in the Apache combined log format
+func combinedAccessLine(req *http.Request, rw *ResponseWriter, start time.Time) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	user := "-"
+	if info := infoOf(req.Context()); info != nil {
+		info.Lock()
+		if info.user != "" {
+			user = info.user
+		}
+		info.Unlock()
+	}
+	return fmt.Sprintf("%s - %s [%s] %q %d %d %q %q",
+		host, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+		req.Method+" "+req.URL.RequestURI()+" "+req.Proto,
+		rw.Status, rw.Size, orDash(req.Referer()), orDash(req.UserAgent()))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// jsonAccessLine formats a request as a single json object
+func jsonAccessLine(req *http.Request, rw *ResponseWriter, start time.Time) string {
+	entry := map[string]interface{}{
+		"time":        start.Format(time.RFC3339Nano),
+		"remote_addr": req.RemoteAddr,
+		"method":      req.Method,
+		"uri":         req.URL.RequestURI(),
+		"proto":       req.Proto,
+		"status":      rw.Status,
+		"size":        rw.Size,
+		"duration_ms": float64(time.Since(start)) / float64(time.Millisecond),
+		"referer":     req.Referer(),
+		"user_agent":  req.UserAgent(),
+	}
+	if info := infoOf(req.Context()); info != nil {
+		info.Lock()
+		entry["request_id"] = info.id
+		if info.user != "" {
+			entry["user"] = info.user
+		}
+		info.Unlock()
+	}
+	js, _ := json.Marshal(entry)
+	return string(js)
+}
+
+// prefixLogger prefixes everything logged with the id of a request
+type prefixLogger struct {
+	Logger
+	prefix string
+}
+
+func (l prefixLogger) LogInfo(msg string) {
+	l.Logger.LogInfo(l.prefix + msg)
+}
+
+func (l prefixLogger) LogInfoF(format string, args ...interface{}) {
+	l.Logger.LogInfoF(l.prefix+format, args...)
+}
+
+func (l prefixLogger) LogErr(err error) {
+	l.Logger.LogErr(errors.New(l.prefix + err.Error()))
+}
+
+// requestLogger returns a logger prefixing the id of the request (if it has one)
+func requestLogger(logger Logger, req *http.Request) Logger {
+	if info := infoOf(req.Context()); info != nil {
+		return prefixLogger{logger, "[" + info.id + "] "}
+	}
+	return logger
+}
@@ -0,0 +1,204 @@
+// Package policy decides which commands and paths the roles of a user may use.
+// The same policy is enforced by the web server and by the broadcast backend.
+//
+//	[policy]
+//	default_role = "reader"
+//	connection_role = ""
+//	identify_secret = "long random string"
+//
+//	[policy.roles.admin]
+//	commands = ["*"]
+//
+//	[policy.roles.reader]
+//	commands = ["cat", "ls", "dir", "edit", "cd", "pwd", "grep", "find"]
+//	paths = ["/public", "/notes"]
+package policy
+
+import (
+	"crypto/subtle"
+	"errors"
+	"path"
+	"strings"
+)
+
+// DeniedPrefix starts the message of every denial so that it can be told
+// apart from other errors once it has crossed the broadcast protocol
+const DeniedPrefix = "forbidden: "
+
+// Config is the policy as written in toml
+type Config struct {
+	// DefaultRole is given to users that have no roles of their own, to
+	// browsers without a login and (unless ConnectionRole is set) to direct
+	// broadcast connections
+	DefaultRole string `toml:"default_role"`
+
+	// ConnectionRole is given to broadcast connections that were not
+	// identified by the web server (such as webterm-cli) instead of the
+	// default role
+	ConnectionRole string `toml:"connection_role"`
+
+	// IdentifySecret is shared by the web server and the broadcast server,
+	// connections may only identify a user by presenting it
+	IdentifySecret string `toml:"identify_secret"`
+
+	Roles map[string]*Role `toml:"roles"`
+}
+
+// Role lists the commands a role may run and the path prefixes it may touch,
+// "*" allows every command and no paths (or "/") allows the whole home directory
+type Role struct {
+	Commands []string `toml:"commands"`
+	Paths    []string `toml:"paths"`
+}
+
+// Denied is returned when none of the roles allow a command or a path
+type Denied struct {
+	Roles   []string
+	Command string
+	Path    string
+}
+
+func (e *Denied) Error() string {
+	who := "no role"
+	if len(e.Roles) == 1 {
+		who = "role " + e.Roles[0]
+	} else if len(e.Roles) > 1 {
+		who = "roles " + strings.Join(e.Roles, ", ")
+	}
+	if e.Path != "" {
+		return DeniedPrefix + who + " may not " + e.Command + " " + e.Path
+	}
+	return DeniedPrefix + who + " may not run " + e.Command
+}
+
+// IsDenied reports whether an error message is a policy denial
+func IsDenied(msg string) bool {
+	return strings.HasPrefix(msg, DeniedPrefix)
+}
+
+// openCommands may be run whatever the roles, they only check the connection
+// and list the commands that exist
+var openCommands = map[string]bool{"PING": true, "CMDS": true}
+
+type role struct {
+	allCommands bool
+	commands    map[string]bool
+	paths       []string
+}
+
+// Policy is a compiled policy, a nil policy (or one without roles) allows everything
+type Policy struct {
+	defaultRole    string
+	connectionRole string
+	secret         string
+	roles          map[string]*role
+}
+
+// New compiles the policy, a config without any roles or identify secret
+// gives a nil policy
+func New(cfg *Config) (*Policy, error) {
+	if cfg == nil || len(cfg.Roles) == 0 && cfg.IdentifySecret == "" {
+		return nil, nil
+	}
+
+	p := &Policy{defaultRole: cfg.DefaultRole, connectionRole: cfg.ConnectionRole, secret: cfg.IdentifySecret}
+	p.roles = make(map[string]*role)
+	for name, r := range cfg.Roles {
+		if r == nil {
+			r = &Role{}
+		}
+		compiled := &role{commands: make(map[string]bool)}
+		for _, cmd := range r.Commands {
+			if cmd == "*" {
+				compiled.allCommands = true
+			}
+			compiled.commands[strings.ToUpper(cmd)] = true
+		}
+		for _, prefix := range r.Paths {
+			if !strings.HasPrefix(prefix, "/") {
+				return nil, errors.New("policy: path " + prefix + " of role " + name + " must start with /")
+			}
+			compiled.paths = append(compiled.paths, path.Clean(prefix))
+		}
+		p.roles[name] = compiled
+	}
+	for _, name := range []string{p.defaultRole, p.connectionRole} {
+		if _, ok := p.roles[name]; name != "" && !ok {
+			return nil, errors.New("policy: role " + name + " is not defined")
+		}
+	}
+	return p, nil
+}
+
+// ConnectionRoles returns the roles of broadcast connections that have not
+// identified a user, nil when they get the default role
+func (p *Policy) ConnectionRoles() []string {
+	if p == nil || p.connectionRole == "" {
+		return nil
+	}
+	return []string{p.connectionRole}
+}
+
+// Secret returns the identify secret, empty when there is none
+func (p *Policy) Secret() string {
+	if p == nil {
+		return ""
+	}
+	return p.secret
+}
+
+// CheckSecret reports whether secret is the identify secret, always false
+// when no secret is configured
+func (p *Policy) CheckSecret(secret string) bool {
+	if p == nil || p.secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(p.secret)) == 1
+}
+
+// AllowCommand returns a *Denied error unless one of the roles may run cmd
+func (p *Policy) AllowCommand(roles []string, cmd string) error {
+	if p == nil || len(p.roles) == 0 || openCommands[strings.ToUpper(cmd)] {
+		return nil
+	}
+	roles = p.effective(roles)
+	for _, name := range roles {
+		if r, ok := p.roles[name]; ok && (r.allCommands || r.commands[strings.ToUpper(cmd)]) {
+			return nil
+		}
+	}
+	return &Denied{Roles: roles, Command: strings.ToLower(cmd)}
+}
+
+// AllowPath returns a *Denied error unless one of the roles may use the path,
+// name is relative to the home directory and starts with a /
+func (p *Policy) AllowPath(roles []string, cmd, name string) error {
+	if p == nil || len(p.roles) == 0 {
+		return nil
+	}
+	roles = p.effective(roles)
+	name = path.Clean("/" + name)
+	for _, n := range roles {
+		r, ok := p.roles[n]
+		if !ok {
+			continue
+		}
+		if len(r.paths) == 0 {
+			return nil
+		}
+		for _, prefix := range r.paths {
+			if prefix == "/" || name == prefix || strings.HasPrefix(name, prefix+"/") {
+				return nil
+			}
+		}
+	}
+	return &Denied{Roles: roles, Command: strings.ToLower(cmd), Path: name}
+}
+
+// effective returns the roles used for a user, the default role when the user has none
+func (p *Policy) effective(roles []string) []string {
+	if len(roles) == 0 && p.defaultRole != "" {
+		return []string{p.defaultRole}
+	}
+	return roles
+}
@@ -0,0 +1,129 @@
+package policy
+
+import "testing"
+
+func testPolicy(t *testing.T) *Policy {
+	p, err := New(&Config{
+		DefaultRole:    "reader",
+		ConnectionRole: "cli",
+		IdentifySecret: "s3cret",
+		Roles: map[string]*Role{
+			"admin":  {Commands: []string{"*"}},
+			"reader": {Commands: []string{"cat", "ls"}, Paths: []string{"/public"}},
+			"cli":    {Commands: []string{"ls"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestAllowCommand(t *testing.T) {
+	p := testPolicy(t)
+	tests := []struct {
+		roles []string
+		cmd   string
+		allow bool
+	}{
+		{[]string{"admin"}, "rm", true},
+		{[]string{"reader"}, "cat", true},
+		{[]string{"reader"}, "CAT", true},
+		{[]string{"reader"}, "rm", false},
+		{[]string{"cli"}, "cat", false},
+		{[]string{"cli", "reader"}, "cat", true},
+		{nil, "cat", true},
+		{nil, "save", false},
+		{[]string{"unknown"}, "cat", false},
+		{[]string{"unknown"}, "ping", true},
+		{[]string{"unknown"}, "cmds", true},
+	}
+	for _, test := range tests {
+		err := p.AllowCommand(test.roles, test.cmd)
+		if allowed := err == nil; allowed != test.allow {
+			t.Errorf("AllowCommand(%v, %q) = %v, want allowed %v", test.roles, test.cmd, err, test.allow)
+		}
+		if err != nil && !IsDenied(err.Error()) {
+			t.Errorf("AllowCommand(%v, %q) = %v, not a denial", test.roles, test.cmd, err)
+		}
+	}
+}
+
+func TestAllowPath(t *testing.T) {
+	p := testPolicy(t)
+	tests := []struct {
+		roles []string
+		name  string
+		allow bool
+	}{
+		{[]string{"admin"}, "/secret/key", true},
+		{[]string{"reader"}, "/public", true},
+		{[]string{"reader"}, "/public/notes.txt", true},
+		{[]string{"reader"}, "/public/../secret", false},
+		{[]string{"reader"}, "/publicity", false},
+		{[]string{"reader"}, "/", false},
+		{nil, "/public/a", true},
+		{nil, "/private/a", false},
+		{[]string{"cli"}, "/private/a", true},
+	}
+	for _, test := range tests {
+		err := p.AllowPath(test.roles, "cat", test.name)
+		if allowed := err == nil; allowed != test.allow {
+			t.Errorf("AllowPath(%v, %q) = %v, want allowed %v", test.roles, test.name, err, test.allow)
+		}
+	}
+}
+
+func TestNilPolicyAllowsEverything(t *testing.T) {
+	for _, cfg := range []*Config{nil, {}, {IdentifySecret: "s3cret"}} {
+		p, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.AllowCommand(nil, "rm"); err != nil {
+			t.Errorf("AllowCommand with %+v = %v", cfg, err)
+		}
+		if err := p.AllowPath(nil, "rm", "/any"); err != nil {
+			t.Errorf("AllowPath with %+v = %v", cfg, err)
+		}
+	}
+}
+
+func TestCheckSecret(t *testing.T) {
+	p := testPolicy(t)
+	tests := []struct {
+		secret string
+		ok     bool
+	}{
+		{"s3cret", true},
+		{"s3cre", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if ok := p.CheckSecret(test.secret); ok != test.ok {
+			t.Errorf("CheckSecret(%q) = %v, want %v", test.secret, ok, test.ok)
+		}
+	}
+
+	var none *Policy
+	if none.CheckSecret("") {
+		t.Error("a nil policy accepted an empty secret")
+	}
+	noSecret, _ := New(&Config{Roles: map[string]*Role{"admin": {Commands: []string{"*"}}}})
+	if noSecret.CheckSecret("") {
+		t.Error("a policy without a secret accepted an empty secret")
+	}
+}
+
+func TestNewRejectsUndefinedRoles(t *testing.T) {
+	tests := []*Config{
+		{DefaultRole: "missing", Roles: map[string]*Role{"admin": {}}},
+		{ConnectionRole: "missing", Roles: map[string]*Role{"admin": {}}},
+		{Roles: map[string]*Role{"admin": {Paths: []string{"relative"}}}},
+	}
+	for _, cfg := range tests {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("New(%+v) succeeded", cfg)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package webterm
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyxtom/broadcast/client/go/broadcast"
+)
+
+// ErrPoolClosed is returned when a client is requested after the pool was closed
+var ErrPoolClosed = errors.New("broadcast client pool is closed")
+
+// ErrPoolExhausted is returned when every connection is in use for longer than the dial timeout
+var ErrPoolExhausted = errors.New("broadcast client pool exhausted")
+
+// ErrDialTimeout is returned when the broadcast server could not be reached in time
+var ErrDialTimeout = errors.New("timed out connecting to the broadcast server")
+
+// poolTestAfter is how long a connection may sit idle before it is pinged on checkout
+const poolTestAfter = 30 * time.Second
+
+// PoolConfig configures the connections kept to the broadcast server
+type PoolConfig struct {
+	Port     int
+	IP       string
+	Protocol string
+
+	MaxIdle     int           // connections kept open while unused
+	MaxActive   int           // connections checked out at once, 0 for no limit
+	DialTimeout time.Duration // time allowed to connect, also the wait for a free connection
+	IdleTimeout time.Duration // unused connections are closed after this long, 0 to keep them
+}
+
+// PoolStats describes the connections of a pool
+type PoolStats struct {
+	Idle       int    // connections kept open while unused
+	Active     int    // connections checked out
+	Dials      uint64 // connections made
+	DialErrors uint64 // failed attempts to connect
+}
+
+type idleClient struct {
+	client   Conn
+	lastUsed time.Time
+}
+
+// ClientPool shares connections to the broadcast server between requests
+type ClientPool struct {
+	sync.Mutex
+
+	config *PoolConfig
+	idle   []*idleClient
+	active chan struct{}
+	inUse  int
+	closed bool
+
+	dials      uint64
+	dialErrors uint64
+}
+
+// NewClientPool returns an empty pool, connections are made as they are needed
+func NewClientPool(config *PoolConfig) *ClientPool {
+	pool := new(ClientPool)
+	pool.config = config
+	if config.MaxActive > 0 {
+		pool.active = make(chan struct{}, config.MaxActive)
+	}
+	return pool
+}
+
+// Get returns a connection from the pool, idle connections are reused when
+// they are still healthy and a new one is made otherwise. Every connection
+// must be handed back through Put.
+func (pool *ClientPool) Get() (Conn, error) {
+	if err := pool.acquire(); err != nil {
+		return nil, err
+	}
+
+	for {
+		ic, err := pool.popIdle()
+		if err != nil {
+			pool.release()
+			return nil, err
+		}
+		if ic == nil {
+			break
+		}
+		if time.Since(ic.lastUsed) < poolTestAfter {
+			pool.checkedOut(1)
+			return ic.client, nil
+		}
+		if _, err := ic.client.Do("PING"); err == nil {
+			pool.checkedOut(1)
+			return ic.client, nil
+		}
+		ic.client.Close()
+	}
+
+	c, err := pool.Dial()
+	if err != nil {
+		pool.release()
+		return nil, err
+	}
+	pool.checkedOut(1)
+	return c, nil
+}
+
+// Put hands a connection back to the pool, err is the error of the last
+// command sent on it (if any) in which case the connection is closed instead
+func (pool *ClientPool) Put(c Conn, err error) {
+	defer pool.release()
+
+	pool.Lock()
+	pool.inUse--
+	if err != nil || pool.closed || len(pool.idle) >= pool.config.MaxIdle {
+		pool.Unlock()
+		c.Close()
+		return
+	}
+	pool.idle = append(pool.idle, &idleClient{c, time.Now()})
+	pool.Unlock()
+}
+
+// Dial makes a new connection outside of the pool, giving up after the dial timeout
+func (pool *ClientPool) Dial() (Conn, error) {
+	result := make(chan dialResult, 1)
+	go func() {
+		c, err := broadcast.NewClient(pool.config.Port, pool.config.IP, 1, pool.config.Protocol)
+		if err != nil {
+			atomic.AddUint64(&pool.dialErrors, 1)
+		} else {
+			atomic.AddUint64(&pool.dials, 1)
+		}
+		result <- dialResult{c, err}
+	}()
+
+	timeout := pool.config.DialTimeout
+	if timeout <= 0 {
+		r := <-result
+		return r.conn()
+	}
+	select {
+	case r := <-result:
+		return r.conn()
+	case <-time.After(timeout):
+		// close the connection if it does get made after all
+		go func() {
+			if r := <-result; r.err == nil {
+				r.client.Close()
+			}
+		}()
+		return nil, ErrDialTimeout
+	}
+}
+
+type dialResult struct {
+	client *broadcast.Client
+	err    error
+}
+
+// conn returns the connection made, a nil interface when it failed
+func (r dialResult) conn() (Conn, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.client, nil
+}
+
+// Close closes every idle connection, connections still in use are closed as they are handed back
+func (pool *ClientPool) Close() {
+	pool.Lock()
+	idle := pool.idle
+	pool.idle = nil
+	pool.closed = true
+	pool.Unlock()
+
+	for _, ic := range idle {
+		ic.client.Close()
+	}
+}
+
+// Stats returns the number of idle and checked out connections along with
+// the connections made so far
+func (pool *ClientPool) Stats() PoolStats {
+	pool.Lock()
+	defer pool.Unlock()
+	return PoolStats{
+		Idle:       len(pool.idle),
+		Active:     pool.inUse,
+		Dials:      atomic.LoadUint64(&pool.dials),
+		DialErrors: atomic.LoadUint64(&pool.dialErrors),
+	}
+}
+
+func (pool *ClientPool) checkedOut(n int) {
+	pool.Lock()
+	pool.inUse += n
+	pool.Unlock()
+}
+
+// popIdle takes the most recently used idle connection, closing any that have
+// been idle for longer than the idle timeout
+func (pool *ClientPool) popIdle() (*idleClient, error) {
+	pool.Lock()
+	defer pool.Unlock()
+	if pool.closed {
+		return nil, ErrPoolClosed
+	}
+
+	if timeout := pool.config.IdleTimeout; timeout > 0 {
+		fresh := pool.idle[:0]
+		for _, ic := range pool.idle {
+			if time.Since(ic.lastUsed) > timeout {
+				ic.client.Close()
+			} else {
+				fresh = append(fresh, ic)
+			}
+		}
+		pool.idle = fresh
+	}
+
+	if len(pool.idle) == 0 {
+		return nil, nil
+	}
+	ic := pool.idle[len(pool.idle)-1]
+	pool.idle = pool.idle[:len(pool.idle)-1]
+	return ic, nil
+}
+
+// acquire waits for one of the active connection slots to free up
+func (pool *ClientPool) acquire() error {
+	if pool.active == nil {
+		return nil
+	}
+	if pool.config.DialTimeout <= 0 {
+		pool.active <- struct{}{}
+		return nil
+	}
+	select {
+	case pool.active <- struct{}{}:
+		return nil
+	case <-time.After(pool.config.DialTimeout):
+		return ErrPoolExhausted
+	}
+}
+
+func (pool *ClientPool) release() {
+	if pool.active != nil {
+		<-pool.active
+	}
+}
@@ -0,0 +1,170 @@
+package webterm
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// certReloader holds the certificate (and client CA) served over TLS, they
+// are read again on reload so that renewed certificates are picked up by new
+// connections without closing the listener
+type certReloader struct {
+	sync.RWMutex
+
+	certFile   string
+	keyFile    string
+	caFile     string
+	clientAuth tls.ClientAuthType
+
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// newCertReloader loads the certificate and key, caFile enables client
+// certificates which are required unless clientAuth is "optional"
+func newCertReloader(certFile, keyFile, caFile, clientAuth string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if caFile != "" {
+		switch clientAuth {
+		case "", "require":
+			r.clientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			r.clientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, errors.New("web_tls_client_auth must be require or optional, not " + clientAuth)
+		}
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload reads the certificate, key and client CA files again, the ones in
+// use are kept when any of them fails to load
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		data, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.New(r.caFile + ": no certificates found")
+		}
+	}
+
+	r.Lock()
+	r.cert = &cert
+	r.clientCAs = pool
+	r.Unlock()
+	return nil
+}
+
+// config returns the tls configuration of the listener, every handshake uses
+// the certificates loaded last
+func (r *certReloader) config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.RLock()
+			defer r.RUnlock()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+				ClientCAs:    r.clientCAs,
+				ClientAuth:   r.clientAuth,
+			}, nil
+		},
+	}
+}
+
+// ReloadCerts reads the tls certificates again, the listener is left open
+func (server *WebServer) ReloadCerts() {
+	if err := server.certs.reload(); err != nil {
+		server.LogErr(err)
+		return
+	}
+	server.LogInfo("reloaded tls certificates")
+}
+
+// listenTLS serves https on the inherited file descriptor (or a new listener)
+// and keeps a copy of the socket to hand over on a graceful restart
+func (server *WebServer) listenTLS() error {
+	var ln net.Listener
+	var err error
+	if fd := server.httpServer.FileDescriptor; fd != 0 {
+		ln, err = net.FileListener(os.NewFile(uintptr(fd), "listener"))
+	} else {
+		ln, err = net.Listen("tcp", server.httpServer.Addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	tcp, ok := ln.(*net.TCPListener)
+	if !ok {
+		ln.Close()
+		return errors.New("tls is only supported on tcp listeners")
+	}
+	server.listenerFile, err = tcp.File()
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	return server.httpServer.Server.Serve(tls.NewListener(ln, server.certs.config()))
+}
+
+// listenRedirect starts a plain http listener on addr sending every request
+// over to https, it is not handed over on a graceful restart
+func (server *WebServer) listenRedirect(addr string) {
+	_, port, _ := net.SplitHostPort(server.httpServer.Addr)
+	server.redirectServer = &http.Server{
+		Addr:         addr,
+		ReadTimeout:  server.httpServer.ReadTimeout,
+		WriteTimeout: server.httpServer.WriteTimeout,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			host, _, err := net.SplitHostPort(req.Host)
+			if err != nil {
+				host = req.Host
+			}
+			if port != "" && port != "443" {
+				host = net.JoinHostPort(host, port)
+			}
+			http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+		}),
+	}
+
+	server.LogInfoF("redirecting http on %s to https", addr)
+	go func() {
+		err := server.redirectServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			server.LogErr(err)
+		}
+	}()
+}
+
+// certSession logs in the user named by a verified client certificate, nil
+// when the request has none or the name is not an account of the users file
+func (handler *Handler) certSession(req *http.Request) *Session {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	sum := sha256.Sum256(cert.Raw)
+	return handler.auth.CertSession(cert.Subject.CommonName, hex.EncodeToString(sum[:]), req.RemoteAddr)
+}
@@ -1,46 +1,51 @@
-package main
+package webterm
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"html/template"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
-	"path"
-	"regexp"
-	"strconv"
 	"strings"
 	"syscall"
 
-	"github.com/nyxtom/broadcast/client/go/broadcast"
 	"github.com/nyxtom/gracefulhttp"
 	"github.com/nyxtom/workclient"
 )
 
+// ErrRedirectWithoutTLS is returned when web_redirect_addr is set while https is not served
+var ErrRedirectWithoutTLS = errors.New("web_redirect_addr requires web_tls_cert and web_tls_key")
+
 // WebServer is a simple work client enabled http server
 type WebServer struct {
 	workclient.WorkClient
-	cmdArgs    []string
-	closed     bool
-	httpServer *gracefulhttp.Server
-	bport      int
-	bip        string
-	bprotocol  string
+	cmdArgs        []string
+	closed         bool
+	httpServer     *gracefulhttp.Server
+	certs          *certReloader
+	listenerFile   *os.File
+	redirectAddr   string
+	redirectServer *http.Server
+	handler        *Handler
 }
 
 type WebConfig struct {
 	workclient.Config
 
-	// broadcast configuration
-	BroadcastPort  int    `toml:"broadcast_port" default:"7337"`
-	BroadcastIP    string `toml:"broadcast_ip" default:"127.0.0.1"`
-	BroadcastProto string `toml:"broadcast_proto" default:"redis"`
+	// tls configuration, https is served when a certificate and key are given
+	WebTLSCert       string `toml:"web_tls_cert"`
+	WebTLSKey        string `toml:"web_tls_key"`
+	WebTLSClientCA   string `toml:"web_tls_client_ca"`
+	WebTLSClientAuth string `toml:"web_tls_client_auth" default:"require"`
+	WebRedirectAddr  string `toml:"web_redirect_addr"`
+
+	HandlerConfig
 }
 
-// NewWebServer returns a work client enabled http server
-func NewWebServer(config *WebConfig, fd int, cmdArgs []string) *WebServer {
+// NewWebServer returns a work client enabled http server, failing when the
+// certificates or the handler config can not be loaded
+func NewWebServer(config *WebConfig, fd int, cmdArgs []string) (*WebServer, error) {
 	server := new(WebServer)
 	server.cmdArgs = cmdArgs
 	server.httpServer = gracefulhttp.NewServer(config.WebAddr, 0)
@@ -48,24 +53,48 @@ func NewWebServer(config *WebConfig, fd int, cmdArgs []string) *WebServer {
 	server.httpServer.WriteTimeout = config.WriteTimeout
 	server.httpServer.MaxHeaderBytes = config.MaxHeaderBytes
 	server.httpServer.FileDescriptor = fd
+	if config.WebTLSCert != "" || config.WebTLSKey != "" {
+		certs, err := newCertReloader(config.WebTLSCert, config.WebTLSKey, config.WebTLSClientCA, config.WebTLSClientAuth)
+		if err != nil {
+			return nil, err
+		}
+		server.certs = certs
+		server.redirectAddr = config.WebRedirectAddr
+	} else if config.WebRedirectAddr != "" {
+		return nil, ErrRedirectWithoutTLS
+	}
 	server.Configure(config.Config, server.listen, server.stopListening)
-	server.bport = config.BroadcastPort
-	server.bip = config.BroadcastIP
-	server.bprotocol = config.BroadcastProto
-	return server
+
+	handlerConfig := config.HandlerConfig
+	handlerConfig.Logger = server
+	handler, err := NewHandler(&handlerConfig)
+	if err != nil {
+		return nil, err
+	}
+	server.handler = handler
+	server.httpServer.Handler = handler
+	return server, nil
 }
 
 // ServeWeb will create a web server, attach signal flags and run the worker
-func ServeWeb(config *WebConfig, fd int, cmdArgs []string) {
-	server := NewWebServer(config, fd, cmdArgs)
+func ServeWeb(config *WebConfig, fd int, cmdArgs []string) error {
+	server, err := NewWebServer(config, fd, cmdArgs)
+	if err != nil {
+		return err
+	}
 	server.AttachSignals()
 	server.Run()
+	return nil
 }
 
 // RestartGraceful will perform a no-downtime restart by passing off the socket to the forked process
 func (server *WebServer) RestartGraceful() {
 	server.LogInfo("initiated graceful restart for web server")
 	fd := server.httpServer.Fd()
+	if server.listenerFile != nil {
+		// the https listener is handed over as the first extra file
+		fd = 3
+	}
 	args := []string{}
 	for _, k := range server.cmdArgs[1:] {
 		if !strings.Contains(k, "--fd=") {
@@ -76,17 +105,23 @@ func (server *WebServer) RestartGraceful() {
 	cmd := exec.Command(server.cmdArgs[0], args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	if server.listenerFile != nil {
+		cmd.ExtraFiles = []*os.File{server.listenerFile}
+	}
 	err := cmd.Start()
 	if err != nil {
 		server.LogErr(err)
 	}
 }
 
-// AttachSignals will create a channel to OS.Signal to listen for any signup events..etc
+// AttachSignals will create a channel to OS.Signal to listen for any signup events..etc,
+// SIGHUP reloads the tls certificates (restarting gracefully without tls) and
+// SIGUSR2 restarts gracefully
 func (server *WebServer) AttachSignals() {
-	sc := make(chan os.Signal)
+	sc := make(chan os.Signal, 1)
 	signal.Notify(sc,
 		syscall.SIGHUP,
+		syscall.SIGUSR2,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT,
@@ -96,7 +131,9 @@ func (server *WebServer) AttachSignals() {
 	go func() {
 		for {
 			signal := <-sc
-			if signal == syscall.SIGHUP {
+			if signal == syscall.SIGHUP && server.certs != nil {
+				server.ReloadCerts()
+			} else if signal == syscall.SIGHUP || signal == syscall.SIGUSR2 {
 				server.RestartGraceful()
 			} else {
 				close(sc)
@@ -108,103 +145,41 @@ func (server *WebServer) AttachSignals() {
 }
 
 func (server *WebServer) listen() {
+	scheme := "http"
+	if server.certs != nil {
+		scheme = "https"
+	}
 	if server.httpServer.FileDescriptor == 0 {
-		server.LogInfoF("listening on %s", server.httpServer.Addr)
+		server.LogInfoF("listening on %s (%s)", server.httpServer.Addr, scheme)
 	} else {
-		server.LogInfoF("listening on existing file descriptor %d, %s", server.httpServer.FileDescriptor, server.httpServer.Addr)
+		server.LogInfoF("listening on existing file descriptor %d, %s (%s)", server.httpServer.FileDescriptor, server.httpServer.Addr, scheme)
 	}
 
-	handleFunc("/exec", server.logReq, server.exec)
-	handleFunc("/", server.logReq, server.index)
-	//handleFunc("/restart", server.logReq, server.restart)
-	//handleFunc("/shutdown", server.logReq, server.shutdown)
-	items := []string{"scripts", "styles", "fonts", "static"}
-	for _, k := range items {
-		prefix := "/" + k + "/"
-		dir := path.Join("./app", k)
-		http.Handle(prefix, http.StripPrefix(prefix, http.FileServer(http.Dir(dir))))
+	var err error
+	if server.certs == nil {
+		err = server.httpServer.ListenAndServe()
+	} else {
+		if server.redirectAddr != "" {
+			server.listenRedirect(server.redirectAddr)
+		}
+		err = server.listenTLS()
 	}
-
-	err := server.httpServer.ListenAndServe()
-	if err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		server.LogErr(err)
 		server.Close()
 	}
 }
 
 func (server *WebServer) stopListening() {
-	server.httpServer.Close()
-}
-
-func (server *WebServer) logReq(w http.ResponseWriter, req *http.Request) {
-	server.LogInfoF("%v %v from %v", req.Method, req.URL, req.RemoteAddr)
-}
-
-func (server *WebServer) index(w http.ResponseWriter, req *http.Request) {
-	t, _ := template.ParseFiles(path.Join("./app", "index.html"))
-	t.Execute(w, nil)
-}
-
-func (server *WebServer) exec(w http.ResponseWriter, req *http.Request) {
-	values := req.URL.Query()
-	response := make(map[string]interface{})
-	if len(values["cmd"]) > 0 {
-		c, err := broadcast.NewClient(server.bport, server.bip, 1, server.bprotocol)
-		if err != nil {
-			server.LogErr(err)
-			return
-		}
-		reg, _ := regexp.Compile(`'.*?'|".*?"|\S+`)
-		cmds := reg.FindAllString(values["cmd"][0], -1)
-		if len(cmds) > 0 {
-			args := make([]interface{}, len(cmds[1:]))
-			for i := range args {
-				item := strings.Trim(string(cmds[1+i]), "\"'")
-				if a, err := strconv.Atoi(item); err == nil {
-					args[i] = a
-				} else if a, err := strconv.ParseFloat(item, 64); err == nil {
-					args[i] = a
-				} else if a, err := strconv.ParseBool(item); err == nil {
-					args[i] = a
-				} else if len(item) == 1 {
-					b := []byte(item)
-					args[i] = string(b[0])
-				} else {
-					args[i] = item
-				}
-			}
-			cmd := strings.ToUpper(cmds[0])
-			reply, err := c.Do(cmd, args...)
-			if err != nil {
-				server.LogErr(err)
-			} else {
-				response["cmd"] = cmd
-				response["args"] = args
-				response["reply"] = printReply(cmd, reply, "")
-			}
+	if server.certs == nil {
+		server.httpServer.Close()
+	} else {
+		server.httpServer.Server.Close()
+		if server.redirectServer != nil {
+			server.redirectServer.Close()
 		}
 	}
-
-	js, err := json.Marshal(response)
-	if err != nil {
-		server.LogErr(err)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
-}
-
-func printReply(cmd string, reply interface{}, indent string) interface{} {
-	switch reply := reply.(type) {
-	case []byte:
-		return fmt.Sprintf("%q\n", reply)
-	case nil:
-		return fmt.Sprintf("(nil)\n")
-	case error:
-		return fmt.Sprintf("%s\n", string(reply.Error()))
-	}
-
-	return reply
+	server.handler.Close()
 }
 
 /*
@@ -217,12 +192,3 @@ func (server *WebServer) shutdown(w http.ResponseWriter, req *http.Request) {
 	server.Close()
 }
 */
-
-// handleFunc takes a prefix and a list of http handlers to execute them as an in-order stack
-func handleFunc(path string, fns ...func(http.ResponseWriter, *http.Request)) {
-	http.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
-		for _, fn := range fns {
-			fn(w, req)
-		}
-	})
-}
@@ -0,0 +1,263 @@
+package webterm
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsWriteWait is the time allowed to write a single message to the browser
+	wsWriteWait = 10 * time.Second
+
+	// wsPongWait is how long the connection may stay silent before it is considered dead
+	wsPongWait = 60 * time.Second
+
+	// wsPingPeriod is how often the browser is pinged, must be less than wsPongWait
+	wsPingPeriod = (wsPongWait * 9) / 10
+
+	// wsChunkLines is the number of lines of text output sent per chunk
+	wsChunkLines = 200
+
+	// wsQueueSize is the number of commands a browser may have in flight
+	wsQueueSize = 32
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// wsRequest is a command sent by the browser, id is echoed back on every
+// message belonging to the reply so that commands can be multiplexed. When
+// args is set cmd is the command alone, otherwise cmd is a full command line.
+type wsRequest struct {
+	ID   int64             `json:"id"`
+	Cmd  string            `json:"cmd"`
+	Args []json.RawMessage `json:"args"`
+}
+
+// wsMessage is sent to the browser for every chunk of text output or batch of
+// a streamed reply (grep and find results) and once more with done set and the
+// reply envelope when the command has completed
+type wsMessage struct {
+	ID    int64       `json:"id"`
+	Chunk string      `json:"chunk,omitempty"`
+	Batch interface{} `json:"batch,omitempty"`
+	Done  bool        `json:"done,omitempty"`
+
+	*execResponse
+}
+
+// wsConn is a single browser session, the broadcast connection lives as long
+// as the websocket so the working directory and other state is kept
+type wsConn struct {
+	handler    *Handler
+	ws         *websocket.Conn
+	log        Logger
+	client     Conn
+	session    *Session
+	remoteAddr string
+
+	writeLock sync.Mutex
+	requests  chan *wsRequest
+	done      chan struct{}
+}
+
+func (handler *Handler) websocket(w http.ResponseWriter, req *http.Request) {
+	log := handler.logger(req)
+	ws, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// the upgrader has already replied to the browser
+		log.LogErr(err)
+		return
+	}
+	// the session keeps its own connection rather than tying up one of the pool
+	c, err := handler.backend.Dial()
+	if err != nil {
+		log.LogErr(err)
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "broadcast server unavailable"),
+			time.Now().Add(wsWriteWait))
+		ws.Close()
+		return
+	}
+
+	// commands must never run without the identity of the user, close the socket instead
+	session := sessionOf(req.Context())
+	if err := handler.identify(c, session, false); err != nil {
+		log.LogErr(err)
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "broadcast server unavailable"),
+			time.Now().Add(wsWriteWait))
+		ws.Close()
+		c.Close()
+		return
+	}
+
+	// a reconnecting browser passes along its working directory so it is not lost
+	if cwd := req.URL.Query().Get("cwd"); cwd != "" {
+		if _, err := c.Do("CD", cwd); err != nil {
+			log.LogErr(err)
+		}
+	}
+
+	conn := &wsConn{handler: handler, log: log, ws: ws, client: c, session: session, remoteAddr: req.RemoteAddr}
+	handler.metrics.websockets.Add(1)
+	defer handler.metrics.websockets.Add(-1)
+	conn.requests = make(chan *wsRequest, wsQueueSize)
+	conn.done = make(chan struct{})
+	go conn.process()
+	go conn.ping()
+	conn.read()
+}
+
+// read receives commands from the browser until the connection is closed
+func (conn *wsConn) read() {
+	defer func() {
+		close(conn.done)
+		close(conn.requests)
+		conn.ws.Close()
+	}()
+
+	conn.ws.SetReadLimit(maxExecBody)
+	conn.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.ws.SetPongHandler(func(string) error {
+		conn.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
+
+	for {
+		req := new(wsRequest)
+		if err := conn.ws.ReadJSON(req); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				conn.log.LogErr(err)
+			}
+			return
+		}
+		select {
+		case conn.requests <- req:
+		default:
+			resp := newExecResponse("", nil).fail(newExecError(http.StatusTooManyRequests, "too_many_requests", "too many commands in flight"))
+			conn.write(&wsMessage{ID: req.ID, Done: true, execResponse: resp})
+		}
+	}
+}
+
+// process runs the queued commands in order on the broadcast connection of the session
+func (conn *wsConn) process() {
+	defer conn.client.Close()
+	for req := range conn.requests {
+		// the session may have been logged out or revoked while the socket was open
+		if conn.session != nil && !conn.handler.auth.Valid(conn.session) {
+			resp := newExecResponse("", nil).fail(newExecError(http.StatusUnauthorized, "unauthorized", ErrNoSession.Error()))
+			conn.write(&wsMessage{ID: req.ID, Done: true, execResponse: resp})
+			conn.ws.Close()
+			return
+		}
+
+		cmd, args := parseCommand(req.Cmd)
+		if req.Args != nil {
+			var err error
+			cmd = strings.ToUpper(req.Cmd)
+			if args, err = decodeArgs(cmd, req.Args); err != nil {
+				resp := newExecResponse(cmd, nil).fail(errBadRequest(err.Error()))
+				conn.handler.record(conn.session, conn.remoteAddr, resp)
+				conn.write(&wsMessage{ID: req.ID, Done: true, execResponse: resp})
+				continue
+			}
+		}
+
+		resp := newExecResponse(cmd, args)
+		msg := &wsMessage{ID: req.ID, Done: true, execResponse: resp}
+		if cmd == "" {
+			conn.write(msg)
+			continue
+		}
+		// batches of streamed replies are passed on as soon as they arrive
+		err := conn.handler.run(conn.client, conn.session, resp, func(batch interface{}) error {
+			return conn.write(&wsMessage{ID: req.ID, Batch: batch})
+		})
+		if err != nil {
+			resp.fail(errUnavailable(err))
+		}
+		conn.handler.record(conn.session, conn.remoteAddr, resp)
+		if err != nil {
+			// the browser reconnects with a fresh connection on its next command
+			conn.log.LogErr(err)
+			conn.write(msg)
+			conn.ws.Close()
+			return
+		}
+
+		// text output is only sent once the command is done, long output is
+		// then split into chunks so that no single message gets too large.
+		// Other replies (listings...) are sent whole.
+		if text, ok := resp.Reply.(string); ok && strings.Count(text, "\n") > wsChunkLines {
+			if !conn.sendChunks(req.ID, text) {
+				return
+			}
+			resp.Reply = nil
+		}
+		if err := conn.write(msg); err != nil {
+			return
+		}
+	}
+}
+
+// sendChunks sends the text to the browser a few lines at a time, returning
+// false when the connection has gone away
+func (conn *wsConn) sendChunks(id int64, text string) bool {
+	lines := strings.SplitAfter(text, "\n")
+	for i := 0; i < len(lines); i += wsChunkLines {
+		end := i + wsChunkLines
+		if end > len(lines) {
+			end = len(lines)
+		}
+		chunk := strings.Join(lines[i:end], "")
+		if chunk == "" {
+			continue
+		}
+		if err := conn.write(&wsMessage{ID: id, Chunk: chunk}); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// ping keeps the connection alive through proxies and detects dead browsers
+func (conn *wsConn) ping() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			conn.writeLock.Lock()
+			err := conn.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+			conn.writeLock.Unlock()
+			if err != nil {
+				return
+			}
+		case <-conn.done:
+			return
+		}
+	}
+}
+
+func (conn *wsConn) write(msg *wsMessage) error {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	if msg.execResponse != nil {
+		msg.DurationMs = float64(time.Since(msg.start)) / float64(time.Millisecond)
+	}
+	conn.ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	err := conn.ws.WriteJSON(msg)
+	if err != nil {
+		conn.log.LogErr(err)
+	}
+	return err
+}